@@ -0,0 +1,63 @@
+package spellbook
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+var ErrNoValues = errors.New("No values to aggregate")
+
+// numericField looks up a field which can be aggregated.
+func numericField(ctype *ComponentType, name string) (field, error) {
+	f, ok := ctype.field(name)
+	if !ok {
+		return field{}, fmt.Errorf("Can't aggregate %s: no such field in %s", name, ctype.name)
+	}
+	t := ctype.typ.Field(f.index).Type
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if _, ok := toFloat(reflect.Zero(t)); !ok {
+		return field{}, fmt.Errorf("Can't aggregate %s of %s: not a number", name, ctype.name)
+	}
+	return f, nil
+}
+
+// aggregate works out a sum, min, max or avg of a field of components in
+// memory, skipping nulls as SQL does.
+func aggregate(fn string, f field, cs []*Component) (float64, error) {
+	var result float64
+	n := 0
+	for _, c := range cs {
+		v := reflect.ValueOf(c.data).Elem().Field(f.index)
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				continue
+			}
+			v = v.Elem()
+		}
+		x, _ := toFloat(v)
+		switch {
+		case n == 0 || fn == "sum" || fn == "avg":
+			if n == 0 {
+				result = x
+			} else {
+				result += x
+			}
+		case fn == "min" && x < result, fn == "max" && x > result:
+			result = x
+		}
+		n++
+	}
+	if n == 0 {
+		if fn == "sum" {
+			return 0, nil
+		}
+		return 0, ErrNoValues
+	}
+	if fn == "avg" {
+		result /= float64(n)
+	}
+	return result, nil
+}
@@ -0,0 +1,72 @@
+package spellbook
+
+import (
+	"testing"
+)
+
+func TestAggregates(t *testing.T) {
+	forEachBackend(t, func(m *Manager) {
+		m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
+		for x := 1; x <= 4; x++ {
+			e, _ := m.NewEntity()
+			c, _ := e.NewComponent("xyz!")
+			c.data.(*Xyz).X = x
+			c.data.(*Xyz).Y = x % 2
+			c.Save()
+		}
+
+		q := m.QueryComponent("xyz!")
+		Eq(q, "Y", 1)
+		if n, err := q.Count(); err != nil || n != 2 {
+			t.Error("Counted", n, err)
+		}
+		if ok, err := q.Exists(); err != nil || !ok {
+			t.Error("Found no components", err)
+		}
+		if sum, err := q.Sum("X"); err != nil || sum != 4 {
+			t.Error("Sum was", sum, err)
+		}
+
+		q = m.QueryComponent("xyz!")
+		q.OrderBy("X", Desc)
+		q.Limit(3)
+		if min, err := q.Min("X"); err != nil || min != 2 {
+			t.Error("Min was", min, err)
+		}
+		if max, err := q.Max("X"); err != nil || max != 4 {
+			t.Error("Max was", max, err)
+		}
+		if avg, err := q.Avg("X"); err != nil || avg != 3 {
+			t.Error("Avg was", avg, err)
+		}
+
+		q = m.QueryComponent("xyz!")
+		Gt(q, "X", 10)
+		if ok, err := q.Exists(); err != nil || ok {
+			t.Error("Found components that aren't there", err)
+		}
+		if sum, err := q.Sum("X"); err != nil || sum != 0 {
+			t.Error("Sum of nothing was", sum, err)
+		}
+		if _, err := q.Max("X"); err != ErrNoValues {
+			t.Error("Got", err, "instead of ErrNoValues")
+		}
+	})
+}
+
+func TestAggregatesSkipNulls(t *testing.T) {
+	forEachBackend(t, func(m *Manager) {
+		namesMatching(t, m, func(q Query) {})
+		q := m.QueryComponent("named")
+		if n, err := q.Count(); err != nil || n != 5 {
+			t.Error("Counted", n, err)
+		}
+		// scores are 0, 10, 30 and 40, and Bob has none
+		if avg, err := q.Avg("Score"); err != nil || avg != 20 {
+			t.Error("Avg was", avg, err)
+		}
+		if _, err := q.Sum("Name"); err == nil {
+			t.Error("Summed strings")
+		}
+	})
+}
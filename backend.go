@@ -0,0 +1,114 @@
+package spellbook
+
+// A Backend stores entities and their components for a Manager. NewManager
+// uses a SQL backend, and local components live in a backend made by
+// NewLocalBackend; other stores can be used through NewManagerWithBackend.
+//
+// Components are handed to and from a Backend as pointers to values of their
+// ComponentType's struct type, of which the ComponentType's Fields are stored.
+type Backend interface {
+	// NewEntity allocates the ID of a new entity.
+	NewEntity() (int64, error)
+	// DeleteEntity removes an entity. The Manager removes its components
+	// first.
+	DeleteEntity(id int64) error
+	// Entities lists the IDs of all entities.
+	Entities() (IDs, error)
+
+	// Register prepares the backend to store components of a new type.
+	Register(ctype *ComponentType) error
+	// Get loads an entity's component of the given type, or returns
+	// ErrNoComponent if it has none.
+	Get(ctype *ComponentType, entity int64) (interface{}, error)
+	// Save stores an entity's component, which is new if the entity didn't
+	// have one of its type before.
+	Save(ctype *ComponentType, entity int64, data interface{}, isNew bool) error
+	// Remove deletes an entity's component of the given type, or returns
+	// ErrNoComponent if it has none.
+	Remove(ctype *ComponentType, entity int64) error
+	// Query starts a query over all components of a type. The query's
+	// results should be made with m.Bind. Backends which can't filter
+	// components themselves can return a NewMemoryQuery.
+	Query(m *Manager, ctype *ComponentType) Query
+}
+
+// A TxBackend is a Backend which supports transactions.
+type TxBackend interface {
+	Backend
+	// Begin starts a transaction.
+	Begin() (BackendTx, error)
+}
+
+// A BackendTx is a view of a Backend whose changes all take effect on Commit,
+// or not at all.
+type BackendTx interface {
+	Backend
+	Commit() error
+	Rollback() error
+}
+
+// A MoveBackend is a Backend which can move a component between entities in
+// one step.
+type MoveBackend interface {
+	Backend
+	// Move gives entity from's component of the given type to entity to,
+	// which doesn't have one, storing data as its value. It returns
+	// ErrNoComponent if from has none.
+	Move(ctype *ComponentType, from, to int64, data interface{}) error
+}
+
+// An EntityBackend is a Backend which can look up whether an entity exists
+// without listing them all.
+type EntityBackend interface {
+	Backend
+	HasEntity(id int64) (bool, error)
+}
+
+// hasEntity reports whether b has an entity with the given ID.
+func hasEntity(b Backend, id int64) (bool, error) {
+	if eb, ok := b.(EntityBackend); ok {
+		return eb.HasEntity(id)
+	}
+	ids, err := b.Entities()
+	if err != nil {
+		return false, err
+	}
+	defer ids.Close()
+	for ids.Next() {
+		if ids.ID() == id {
+			return true, nil
+		}
+	}
+	return false, ids.Err()
+}
+
+// IDs iterates over entity IDs.
+type IDs interface {
+	Close() error
+	ID() int64
+	Next() bool
+	Err() error
+}
+
+type sliceIDs struct {
+	slice []int64
+	index int
+}
+
+func (ids *sliceIDs) Close() error {
+	ids.slice = nil
+	return nil
+}
+
+func (ids *sliceIDs) ID() int64 {
+	return ids.slice[ids.index]
+}
+
+func (ids *sliceIDs) Next() bool {
+	ids.index += 1
+	return ids.index < len(ids.slice)
+}
+
+func (ids *sliceIDs) Err() error {
+	return nil
+}
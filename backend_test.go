@@ -0,0 +1,97 @@
+package spellbook
+
+import (
+	"testing"
+)
+
+func TestManagerWithLocalBackend(t *testing.T) {
+	m, err := NewManagerWithBackend(NewLocalBackend())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.RegisterComponent("xyz!", "", Xyz{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e1, _ := m.NewEntity()
+	e2, _ := m.NewEntity()
+	if e1.id == e2.id {
+		t.Error("got two entities with identical identities", e1, e2)
+	}
+	c, _ := e1.NewComponent("xyz!")
+	c.data.(*Xyz).X = 3
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e1.NewComponent("xyz!"); err != ErrDuplicateComponent {
+		t.Error("Created duplicate component:", err)
+	}
+
+	c, err = e1.GetComponent("xyz!")
+	if err != nil || c.data.(*Xyz).X != 3 {
+		t.Error("Failed to get component back", c, err)
+	}
+	if _, err := e2.GetComponent("xyz!"); err != ErrNoComponent {
+		t.Error("Got a component that was never created", err)
+	}
+
+	q := m.QueryComponent("xyz!")
+	Gt(q, "X", 2)
+	cs, err := q.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cs.Next() || cs.Component().Entity().id != e1.id {
+		t.Error("Query didn't find the component")
+	}
+	cs.Close()
+
+	e2.Delete()
+	es, _ := m.GetEntities()
+	n := 0
+	for es.Next() {
+		n++
+	}
+	es.Close()
+	if n != 1 {
+		t.Error("Got", n, "entities instead of 1")
+	}
+}
+
+func TestMemoryQuery(t *testing.T) {
+	m, err := NewManagerWithBackend(NewLocalBackend())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.RegisterComponent("xyz!", "", Xyz{}, nil)
+	ctype := m.componentTypes["xyz!"]
+	components := map[int64]interface{}{ 1: &Xyz{ X: 1 }, 2: &Xyz{ X: 5 }, 3: &Xyz{ X: 3 } }
+
+	e := Compare("X", ">", 2)
+	if err := e.Check(ctype); err != nil {
+		t.Fatal(err)
+	}
+	if !e.Match(ctype, 2, components[2]) || e.Match(ctype, 1, components[1]) {
+		t.Error("Expression matched the wrong components")
+	}
+	if _, ok := Compare("W", "=", 1).Check(ctype).(*FilterError); !ok {
+		t.Error("Checked a comparison of a missing field")
+	}
+
+	q := NewMemoryQuery(m, ctype, func() map[int64]interface{} { return components })
+	q.Filter(e)
+	q.OrderBy("X", Desc)
+	cs, err := q.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make([]int64, 0)
+	for cs.Next() {
+		ids = append(ids, cs.Component().entity)
+	}
+	cs.Close()
+	if len(ids) != 2 || ids[0] != 2 || ids[1] != 3 {
+		t.Error("Got entities", ids, "instead of [2 3]")
+	}
+}
@@ -0,0 +1,75 @@
+package spellbook
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+)
+
+// SchemaVersion is the version of spellbook's own tables understood by this
+// release. NewManager upgrades databases with an older version.
+const SchemaVersion = 2
+
+var ErrSchemaTooNew = errors.New("Database was created by a newer version of spellbook")
+
+// upgrades[i] brings spellbook's tables from version i to version i+1.
+var upgrades = []func(b *sqlBackend, tx *sql.Tx) error{
+	func(b *sqlBackend, tx *sql.Tx) error {
+		_, err := tx.Exec("create table if not exists entities (id " + b.dialect.EntityKey() + ")")
+		return err
+	},
+	func(b *sqlBackend, tx *sql.Tx) error {
+		_, err := tx.Exec("create table if not exists spellbook_migrations (component varchar(255) not null, version integer not null, description text not null, primary key (component, version))")
+		return err
+	},
+}
+
+func (b *sqlBackend) schemaVersion(tx *sql.Tx) (int, error) {
+	var value string
+	err := tx.QueryRow(rebind(b.dialect, "select value from spellbook_meta where name = ?"), "schema_version").Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// bootstrap creates spellbook's tables in a fresh database and upgrades them
+// in one written by an older release.
+func (b *sqlBackend) bootstrap() error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("create table if not exists spellbook_meta (name varchar(64) not null primary key, value text not null)")
+	if err != nil {
+		return err
+	}
+	version, err := b.schemaVersion(tx)
+	if err != nil {
+		return err
+	}
+	if version > SchemaVersion {
+		return ErrSchemaTooNew
+	}
+	if version == SchemaVersion {
+		return tx.Commit()
+	}
+	for v := version; v < SchemaVersion; v++ {
+		if err := upgrades[v](b, tx); err != nil {
+			return err
+		}
+	}
+	if version == 0 {
+		_, err = tx.Exec(rebind(b.dialect, "insert into spellbook_meta (name, value) values (?, ?)"), "schema_version", strconv.Itoa(SchemaVersion))
+	} else {
+		_, err = tx.Exec(rebind(b.dialect, "update spellbook_meta set value = ? where name = ?"), strconv.Itoa(SchemaVersion), "schema_version")
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,56 @@
+package spellbook
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+)
+
+func TestBootstrappingFreshDatabase(t *testing.T) {
+	os.Remove(dbName)
+	db, err := sql.Open("sqlite3", dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewManager(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.NewEntity(); err != nil {
+		t.Fatal("Couldn't create entity in bootstrapped database:", err)
+	}
+
+	var version int
+	err = db.QueryRow("select value from spellbook_meta where name = 'schema_version'").Scan(&version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != SchemaVersion {
+		t.Error("Recorded schema version", version, "instead of", SchemaVersion)
+	}
+
+	// a second manager on the same database must leave it alone
+	m, err = NewManager(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es, _ := m.GetEntities()
+	if !es.Next() {
+		t.Error("Bootstrapping an existing database lost entities")
+	}
+	es.Close()
+}
+
+func TestBootstrappingNewerDatabase(t *testing.T) {
+	db := getEmptyDB()
+	if _, err := NewManager(db); err != nil {
+		t.Fatal(err)
+	}
+	db.Exec("update spellbook_meta set value = ? where name = 'schema_version'", SchemaVersion + 1)
+
+	_, err := NewManager(db)
+	if err != ErrSchemaTooNew {
+		t.Error("Opened a database from a newer spellbook:", err)
+	}
+}
@@ -0,0 +1,126 @@
+package spellbook
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+)
+
+var ErrBadCursor = errors.New("Cursor is malformed or from a query with other ordering")
+
+// cursorToken is what a cursor encodes: the ordering of the query it came
+// from, and the sort keys and entity of the last component returned.
+type cursorToken struct {
+	Keys []string
+	Values []json.RawMessage
+	Entity int64
+}
+
+// keys describes the query's ordering, for checking that a cursor belongs to
+// it.
+func (p *paging) keys() []string {
+	keys := make([]string, len(p.orders))
+	for i, o := range p.orders {
+		keys[i] = o.field + " asc"
+		if o.order == Desc {
+			keys[i] = o.field + " desc"
+		}
+	}
+	return keys
+}
+
+func (p *paging) After(cursor string) {
+	p.after = cursor
+}
+
+// cursor encodes the position of c among the query's components. Without a
+// component, as after an empty page, the position is where the query started,
+// so that polling with the cursor picks up components added later.
+func (p *paging) cursor(ctype *ComponentType, c *Component) string {
+	if c == nil {
+		return p.after
+	}
+	fields, err := p.orderFields(ctype)
+	if err != nil {
+		return ""
+	}
+	cv := reflect.ValueOf(c.data).Elem()
+	token := cursorToken{ Keys: p.keys(), Values: make([]json.RawMessage, len(fields)), Entity: c.entity }
+	for i, f := range fields {
+		v, err := json.Marshal(fieldValue(cv.Field(f.index)))
+		if err != nil {
+			return ""
+		}
+		token.Values[i] = v
+	}
+	b, err := json.Marshal(token)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// afterCursor is the filter matching the components after the cursor given
+// to After, or nil if there is none.
+func (p *paging) afterCursor(ctype *ComponentType) (*Expr, error) {
+	if p.after == "" {
+		return nil, nil
+	}
+	fields, err := p.orderFields(ctype)
+	if err != nil {
+		return nil, err
+	}
+	b, err := base64.RawURLEncoding.DecodeString(p.after)
+	if err != nil {
+		return nil, ErrBadCursor
+	}
+	var token cursorToken
+	if err := json.Unmarshal(b, &token); err != nil {
+		return nil, ErrBadCursor
+	}
+	keys := p.keys()
+	if len(token.Keys) != len(keys) || len(token.Values) != len(keys) {
+		return nil, ErrBadCursor
+	}
+	for i, k := range keys {
+		if token.Keys[i] != k {
+			return nil, ErrBadCursor
+		}
+	}
+
+	// after (a, b, entity) means a is after, or a is the same and b is
+	// after, and so on down to the entity
+	after := Expr{ op: ">", entity: true, value: token.Entity }
+	for i := len(fields) - 1; i >= 0; i-- {
+		f := fields[i]
+		t := ctype.typ.Field(f.index).Type
+		v := reflect.New(t)
+		if err := json.Unmarshal(token.Values[i], v.Interface()); err != nil {
+			return nil, ErrBadCursor
+		}
+		val := fieldValue(v.Elem())
+		nullable := t.Kind() == reflect.Ptr
+		var beyond, same Expr
+		switch {
+		case val == nil:
+			// nulls come first in ascending order and last in descending
+			same = Compare(f.name, "is null", nil)
+			beyond = Or()
+			if p.orders[i].order == Asc {
+				beyond = Compare(f.name, "is not null", nil)
+			}
+		case p.orders[i].order == Asc:
+			same = Compare(f.name, "=", val)
+			beyond = Compare(f.name, ">", val)
+		default:
+			same = Compare(f.name, "=", val)
+			beyond = Compare(f.name, "<", val)
+			if nullable {
+				beyond = Or(beyond, Compare(f.name, "is null", nil))
+			}
+		}
+		after = Or(beyond, And(same, after))
+	}
+	return &after, nil
+}
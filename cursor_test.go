@@ -0,0 +1,106 @@
+package spellbook
+
+import (
+	"testing"
+)
+
+func TestCursorPaging(t *testing.T) {
+	forEachBackend(t, func(m *Manager) {
+		m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
+		for x := 0; x < 7; x++ {
+			e, _ := m.NewEntity()
+			c, _ := e.NewComponent("xyz!")
+			c.data.(*Xyz).X = x
+			c.data.(*Xyz).Y = x % 3
+			c.Save()
+		}
+
+		page := func(cursor string) ([]int, string) {
+			q := m.QueryComponent("xyz!")
+			q.OrderBy("Y", Desc)
+			q.Limit(3)
+			if cursor != "" {
+				q.After(cursor)
+			}
+			cs, err := q.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cs.Close()
+			xs := make([]int, 0)
+			for cs.Next() {
+				xs = append(xs, cs.Component().data.(*Xyz).X)
+			}
+			return xs, cs.Cursor()
+		}
+
+		xs, cursor := page("")
+		if len(xs) != 3 || xs[0] != 2 || xs[1] != 5 || xs[2] != 1 {
+			t.Error("Got", xs, "instead of [2 5 1]")
+		}
+
+		// a component added before the cursor doesn't shift the next page
+		e, _ := m.NewEntity()
+		c, _ := e.NewComponent("xyz!")
+		c.data.(*Xyz).Y = 2
+		c.Save()
+
+		xs, cursor = page(cursor)
+		if len(xs) != 3 || xs[0] != 4 || xs[1] != 0 || xs[2] != 3 {
+			t.Error("Got", xs, "instead of [4 0 3]")
+		}
+		xs, cursor = page(cursor)
+		if len(xs) != 1 || xs[0] != 6 {
+			t.Error("Got", xs, "instead of [6]")
+		}
+
+		// polling past the end waits for new components rather than
+		// starting over
+		last := cursor
+		xs, cursor = page(cursor)
+		if len(xs) != 0 || cursor != last {
+			t.Error("Got", xs, "past the end, and a different cursor")
+		}
+		e, _ = m.NewEntity()
+		c, _ = e.NewComponent("xyz!")
+		c.data.(*Xyz).X = 9
+		c.Save()
+		xs, _ = page(cursor)
+		if len(xs) != 1 || xs[0] != 9 {
+			t.Error("Got", xs, "instead of [9]")
+		}
+
+		q := m.QueryComponent("xyz!")
+		q.OrderBy("X", Asc)
+		q.After(cursor)
+		if _, err := q.Run(); err != ErrBadCursor {
+			t.Error("Resumed from cursor of another ordering", err)
+		}
+	})
+}
+
+func TestCursorPagingNulls(t *testing.T) {
+	forEachBackend(t, func(m *Manager) {
+		namesMatching(t, m, func(q Query) {})
+		names := make([]string, 0)
+		cursor := ""
+		for i := 0; i < 5; i++ {
+			q := m.QueryComponent("named")
+			q.OrderBy("Score", Asc)
+			q.Limit(1)
+			q.After(cursor)
+			cs, err := q.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for cs.Next() {
+				names = append(names, cs.Component().data.(*Named).Name)
+			}
+			cursor = cs.Cursor()
+			cs.Close()
+		}
+		if len(names) != 5 || names[0] != "Bob" || names[1] != "Alice" || names[4] != "Dave" {
+			t.Error("Got", names)
+		}
+	})
+}
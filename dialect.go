@@ -0,0 +1,151 @@
+package spellbook
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A Dialect covers the differences between SQL databases that spellbook has
+// to care about. Spellbook writes its queries with ? placeholders and has the
+// Dialect rewrite them.
+type Dialect interface {
+	// Placeholder is the marker for the nth parameter of a query, counting
+	// from 1.
+	Placeholder(n int) string
+	// Quote quotes an identifier, which may be qualified with dots.
+	Quote(ident string) string
+	// InsertEntity is the statement adding a row to entities. If returning
+	// is true it yields the new row's ID, otherwise the ID is taken from
+	// LastInsertId.
+	InsertEntity() (query string, returning bool)
+	// EntityKey is the column definition of entities.id.
+	EntityKey() string
+	// ColumnType is the column type used to store fields of type t.
+	ColumnType(t reflect.Type) (string, error)
+	// ColumnsQuery is a query listing the columns of table, with a row of
+	// name, type, nullability ("YES" or "NO") and default per column.
+	ColumnsQuery(table string) (query string, args []interface{})
+}
+
+type sqlDialect struct {
+	placeholder func(n int) string
+	quote string
+	insertEntity string
+	returning bool
+	entityKey string
+	types map[reflect.Kind]string
+	columnsQuery string
+	// tableForeignKeys is set for databases which ignore references clauses
+	// on columns, and only enforce foreign keys declared for the table
+	tableForeignKeys bool
+}
+
+var (
+	// SQLite is the dialect of sqlite 3.16 and later, used by default.
+	SQLite Dialect = &sqlDialect{
+		placeholder: func(n int) string { return "?" },
+		quote: `"`,
+		insertEntity: "insert into entities (id) values (null)",
+		entityKey: "integer not null primary key",
+		types: map[reflect.Kind]string{ reflect.Int64: "integer", reflect.Float64: "real", reflect.Slice: "blob" },
+		columnsQuery: `select name, type, case when "notnull" = 1 or pk > 0 then 'NO' else 'YES' end, dflt_value from pragma_table_info(?)`,
+	}
+	// PostgreSQL numbers its placeholders and allocates entity IDs with
+	// insert ... returning.
+	PostgreSQL Dialect = &sqlDialect{
+		placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+		quote: `"`,
+		insertEntity: "insert into entities default values returning id",
+		returning: true,
+		entityKey: "bigserial primary key",
+		types: map[reflect.Kind]string{ reflect.Int64: "bigint", reflect.Float64: "double precision", reflect.Slice: "bytea" },
+		columnsQuery: "select column_name, data_type, is_nullable, column_default from information_schema.columns where table_schema = current_schema() and table_name = ?",
+	}
+	// MySQL quotes identifiers with backticks, and needs foreign keys
+	// declared apart from their columns.
+	MySQL Dialect = &sqlDialect{
+		placeholder: func(n int) string { return "?" },
+		quote: "`",
+		insertEntity: "insert into entities () values ()",
+		entityKey: "bigint not null auto_increment primary key",
+		types: map[reflect.Kind]string{ reflect.Int64: "bigint", reflect.Float64: "double", reflect.Slice: "longblob" },
+		columnsQuery: "select column_name, data_type, is_nullable, column_default from information_schema.columns where table_schema = database() and table_name = ?",
+		tableForeignKeys: true,
+	}
+)
+
+func (d *sqlDialect) Placeholder(n int) string {
+	return d.placeholder(n)
+}
+
+func (d *sqlDialect) Quote(ident string) string {
+	parts := strings.Split(ident, ".")
+	for i, part := range parts {
+		parts[i] = d.quote + strings.Replace(part, d.quote, d.quote + d.quote, -1) + d.quote
+	}
+	return strings.Join(parts, ".")
+}
+
+func (d *sqlDialect) InsertEntity() (string, bool) {
+	return d.insertEntity, d.returning
+}
+
+func (d *sqlDialect) EntityKey() string {
+	return d.entityKey
+}
+
+func (d *sqlDialect) ColumnType(t reflect.Type) (string, error) {
+	ct, err := columnType(t)
+	if err != nil {
+		return "", err
+	}
+	switch ct {
+	case "integer":
+		return d.types[reflect.Int64], nil
+	case "real":
+		return d.types[reflect.Float64], nil
+	case "blob":
+		return d.types[reflect.Slice], nil
+	}
+	return ct, nil
+}
+
+func (d *sqlDialect) ColumnsQuery(table string) (string, []interface{}) {
+	return d.columnsQuery, []interface{}{table}
+}
+
+// WithDialect sets the dialect of SQL spoken to the database, which defaults
+// to SQLite.
+func WithDialect(d Dialect) ManagerOption {
+	return func(b *sqlBackend) {
+		b.dialect = d
+	}
+}
+
+// rebind rewrites the ? placeholders of query into the dialect's style,
+// leaving alone anything quoted.
+func rebind(d Dialect, query string) string {
+	if d.Placeholder(1) == "?" {
+		return query
+	}
+	var out strings.Builder
+	n := 0
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"' || r == '`':
+			quote = r
+		case r == '?':
+			n++
+			out.WriteString(d.Placeholder(n))
+			continue
+		}
+		out.WriteRune(r)
+	}
+	return out.String()
+}
@@ -0,0 +1,219 @@
+package spellbook
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recorderDriver is a fake database driver which records the SQL it is given,
+// answering queries with no rows except for those returning a new ID.
+type recorderDriver struct {
+	mu sync.Mutex
+	queries []string
+}
+
+var recorder = &recorderDriver{}
+
+func init() {
+	sql.Register("spellbook-recorder", recorder)
+}
+
+func (d *recorderDriver) record(query string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.queries = append(d.queries, query)
+}
+
+func (d *recorderDriver) reset() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	queries := d.queries
+	d.queries = nil
+	return queries
+}
+
+func (d *recorderDriver) Open(name string) (driver.Conn, error) {
+	return recorderConn{}, nil
+}
+
+type recorderConn struct{}
+
+func (c recorderConn) Prepare(query string) (driver.Stmt, error) {
+	return recorderStmt{query}, nil
+}
+func (c recorderConn) Close() error {
+	return nil
+}
+func (c recorderConn) Begin() (driver.Tx, error) {
+	return recorderTx{}, nil
+}
+
+type recorderTx struct{}
+
+func (tx recorderTx) Commit() error {
+	return nil
+}
+func (tx recorderTx) Rollback() error {
+	return nil
+}
+
+type recorderStmt struct {
+	query string
+}
+
+func (s recorderStmt) Close() error {
+	return nil
+}
+func (s recorderStmt) NumInput() int {
+	return -1
+}
+func (s recorderStmt) Exec(args []driver.Value) (driver.Result, error) {
+	recorder.record(s.query)
+	return recorderResult{}, nil
+}
+func (s recorderStmt) Query(args []driver.Value) (driver.Rows, error) {
+	recorder.record(s.query)
+	if strings.Contains(s.query, "returning id") {
+		return &recorderRows{ values: []driver.Value{ int64(42) } }, nil
+	}
+	return &recorderRows{}, nil
+}
+
+type recorderResult struct{}
+
+func (r recorderResult) LastInsertId() (int64, error) {
+	return 42, nil
+}
+func (r recorderResult) RowsAffected() (int64, error) {
+	return 1, nil
+}
+
+type recorderRows struct {
+	values []driver.Value
+}
+
+func (rs *recorderRows) Columns() []string {
+	if rs.values == nil {
+		return []string{}
+	}
+	return []string{"id"}
+}
+func (rs *recorderRows) Close() error {
+	return nil
+}
+func (rs *recorderRows) Next(dest []driver.Value) error {
+	if rs.values == nil {
+		return io.EOF
+	}
+	copy(dest, rs.values)
+	rs.values = nil
+	return nil
+}
+
+func TestPostgreSQLDialect(t *testing.T) {
+	db, _ := sql.Open("spellbook-recorder", "")
+	recorder.reset()
+	m, err := NewManager(db, WithDialect(PostgreSQL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, _ := structFields(reflect.TypeOf(Xyz{}))
+	m.componentTypes["xyz!"] = &ComponentType{ name: "xyz!", table: "xyz", typ: reflect.TypeOf(Xyz{}), fields: fields }
+
+	e, err := m.NewEntity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.id != 42 {
+		t.Error("Didn't take the entity ID from insert ... returning:", e.id)
+	}
+	c, err := e.NewComponent("xyz!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	q := m.QueryComponent("xyz!")
+	Gt(q, "X", 1)
+	Eq(q, "Y", 2)
+	expected := `select "entity_id", "X", "Y", "Z" from "xyz" where "X" > $1 and "Y" = $2`
+	if s := q.(*dbQuery).toString(); s != expected {
+		t.Error("Wrong query:", s)
+	}
+
+	queries := recorder.reset()
+	for _, query := range queries {
+		if strings.Contains(query, "?") {
+			t.Error("Query with ? placeholders:", query)
+		}
+	}
+	expected = `insert into "xyz" ("X", "Y", "Z", "entity_id") values ($1, $2, $3, $4)`
+	if queries[len(queries) - 1] != expected {
+		t.Error("Wrong insert:", queries[len(queries) - 1])
+	}
+}
+
+func TestRebindSkipsQuotes(t *testing.T) {
+	s := rebind(PostgreSQL, `select "a?" from t where b = ? and c = '?' and d = ?`)
+	if s != `select "a?" from t where b = $1 and c = '?' and d = $2` {
+		t.Error("Wrong rebinding:", s)
+	}
+}
+
+func TestQuotingReservedTableName(t *testing.T) {
+	m := getEmptyManager()
+	err := m.RegisterComponent("order", "order", Xyz{}, nil, AutoCreate())
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, _ := m.NewEntity()
+	c, _ := e.NewComponent("order")
+	c.data.(*Xyz).X = 8
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	c, err = e.GetComponent("order")
+	if err != nil || c.data.(*Xyz).X != 8 {
+		t.Error("Failed to get component back", c, err)
+	}
+}
+
+func TestQuotingColumnsAsTheDatabaseNamesThem(t *testing.T) {
+	db := getEmptyDB()
+	// as PostgreSQL would have it after folding unquoted names
+	db.Exec("create table folded (entity_id integer not null primary key, x integer not null, y integer not null, z integer not null)")
+	m, err := NewManager(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.RegisterComponent("folded", "folded", Xyz{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	q := m.QueryComponent("folded")
+	Gt(q, "X", 1)
+	expected := `select "entity_id", "x", "y", "z" from "folded" where "x" > ?`
+	if s := q.(*dbQuery).toString(); s != expected {
+		t.Error("Wrong query:", s)
+	}
+}
+
+func TestMySQLTableForeignKey(t *testing.T) {
+	fields, _ := structFields(reflect.TypeOf(Nd{}))
+	ctype := &ComponentType{ name: "nd", table: "nd", typ: reflect.TypeOf(Nd{}), fields: fields }
+	b := &sqlBackend{ dialect: MySQL, entityColumn: "entity_id" }
+	s, err := b.createTableSQL(ctype)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "create table if not exists `nd` (`entity_id` bigint not null primary key, `N` text not null, foreign key (`entity_id`) references entities(id) on delete cascade)"
+	if s != expected {
+		t.Error("Wrong create table:", s)
+	}
+}
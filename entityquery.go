@@ -0,0 +1,226 @@
+package spellbook
+
+import (
+	"sort"
+)
+
+// An EntityQuery finds entities having a component of each of several types,
+// each of which may be filtered like any other Query, and lacking components
+// of others. Stored components are matched with a single join; local ones are
+// matched in memory. So are stored ones whose Query is ordered, limited,
+// offset or resumed from a cursor, since paging picks which components are
+// considered before entities are matched, whichever backend holds them.
+type EntityQuery struct {
+	manager *Manager
+	names []string
+	queries []Query
+	without []*ComponentType
+	err error
+}
+
+// QueryEntities starts a query over entities. With no components added, it
+// matches every entity.
+func (m *Manager) QueryEntities() *EntityQuery {
+	return &EntityQuery{ manager: m }
+}
+
+// With restricts the query to entities having a component of the given type,
+// returning the Query which that component has to match. Adding the same
+// type twice returns the same Query.
+func (eq *EntityQuery) With(name string) Query {
+	for i, n := range eq.names {
+		if n == name {
+			return eq.queries[i]
+		}
+	}
+	q := eq.manager.QueryComponent(name)
+	eq.names = append(eq.names, name)
+	eq.queries = append(eq.queries, q)
+	return q
+}
+
+// Without restricts the query to entities lacking a component of the given
+// type.
+func (eq *EntityQuery) Without(name string) *EntityQuery {
+	ctype, ok := eq.manager.componentTypes[name]
+	if !ok {
+		eq.err = ErrComponentNotRegistered
+		return eq
+	}
+	eq.without = append(eq.without, ctype)
+	return eq
+}
+
+// tuple is an entity and its components of the types queried.
+type tuple struct {
+	entity int64
+	components []*Component
+}
+
+// Tuples iterates over the entities found by an EntityQuery.
+type Tuples struct {
+	manager *Manager
+	names []string
+	rows []tuple
+	index int
+}
+
+func (ts *Tuples) Next() bool {
+	ts.index += 1
+	return ts.index < len(ts.rows)
+}
+
+func (ts *Tuples) Entity() *Entity {
+	return &Entity{ ts.rows[ts.index].entity, ts.manager }
+}
+
+// Components are the entity's components, in the order their types were
+// added to the query.
+func (ts *Tuples) Components() []*Component {
+	return ts.rows[ts.index].components
+}
+
+// Component is the entity's component of the given type, or nil if the type
+// wasn't queried.
+func (ts *Tuples) Component(name string) *Component {
+	for i, n := range ts.names {
+		if n == name {
+			return ts.rows[ts.index].components[i]
+		}
+	}
+	return nil
+}
+
+func (ts *Tuples) Err() error {
+	return nil
+}
+
+func (ts *Tuples) Close() error {
+	ts.rows = nil
+	return nil
+}
+
+func (eq *EntityQuery) Run() (*Tuples, error) {
+	if eq.err != nil {
+		return nil, eq.err
+	}
+	var joined []*dbQuery
+	var positions []int
+	found := make(map[int]map[int64]*Component)
+	for i, q := range eq.queries {
+		if dq, ok := q.(*dbQuery); ok && !dq.paged() {
+			if dq.err != nil {
+				return nil, dq.err
+			}
+			joined = append(joined, dq)
+			positions = append(positions, i)
+			continue
+		}
+		cs, err := q.Run()
+		if err != nil {
+			return nil, err
+		}
+		found[i] = make(map[int64]*Component)
+		for cs.Next() {
+			c := cs.Component()
+			found[i][c.entity] = c
+		}
+		err = cs.Err()
+		cs.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// stored components to be done without are left to the database unless
+	// the candidates come from memory
+	sb, isSQL := sqlBackendOf(eq.manager.backend)
+	var sqlWithout, checkWithout []*ComponentType
+	for _, ctype := range eq.without {
+		if isSQL && !ctype.local && (len(joined) > 0 || len(found) == 0) {
+			sqlWithout = append(sqlWithout, ctype)
+		} else {
+			checkWithout = append(checkWithout, ctype)
+		}
+	}
+
+	var candidates []tuple
+	var err error
+	if len(joined) > 0 || len(sqlWithout) > 0 {
+		candidates, err = sb.join(joined, sqlWithout)
+		if err == nil {
+			n := len(eq.queries)
+			for r, row := range candidates {
+				components := make([]*Component, n)
+				for j, c := range row.components {
+					components[positions[j]] = c
+				}
+				candidates[r].components = components
+			}
+		}
+	} else {
+		candidates, err = eq.candidates(found)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]tuple, 0, len(candidates))
+	for _, row := range candidates {
+		matched := true
+		for i, cs := range found {
+			c, ok := cs[row.entity]
+			if !ok {
+				matched = false
+				break
+			}
+			row.components[i] = c
+		}
+		for _, ctype := range checkWithout {
+			if !matched {
+				break
+			}
+			_, err := eq.manager.backendFor(ctype).Get(ctype, row.entity)
+			if err == nil {
+				matched = false
+			} else if err != ErrNoComponent {
+				return nil, err
+			}
+		}
+		if matched {
+			rows = append(rows, row)
+		}
+	}
+	return &Tuples{ eq.manager, eq.names, rows, -1 }, nil
+}
+
+// candidates lists the entities which may match a query done in memory:
+// those with the first component found, or else all of them.
+func (eq *EntityQuery) candidates(found map[int]map[int64]*Component) ([]tuple, error) {
+	n := len(eq.queries)
+	ids := make([]int64, 0)
+	if n > 0 {
+		for id, _ := range found[0] {
+			ids = append(ids, id)
+		}
+	} else {
+		es, err := eq.manager.backend.Entities()
+		if err != nil {
+			return nil, err
+		}
+		for es.Next() {
+			ids = append(ids, es.ID())
+		}
+		err = es.Err()
+		es.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	rows := make([]tuple, len(ids))
+	for i, id := range ids {
+		rows[i] = tuple{ id, make([]*Component, n) }
+	}
+	return rows, nil
+}
@@ -0,0 +1,209 @@
+package spellbook
+
+import (
+	"testing"
+)
+
+func TestQueryEntitiesJoin(t *testing.T) {
+	m := getEmptyManager()
+	m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
+	m.RegisterComponent("N?", "nd", Nd{}, nil)
+	m.RegisterLocalComponent("So?", So{}, nil)
+
+	want := make(map[int64]bool)
+	for i := 0; i < 6; i++ {
+		e, _ := m.NewEntity()
+		c, _ := e.NewComponent("xyz!")
+		c.data.(*Xyz).X = i
+		c.Save()
+		if i % 2 == 0 {
+			c, _ = e.NewComponent("N?")
+			c.data.(*Nd).N = "even"
+			c.Save()
+		}
+		if i != 4 {
+			c, _ = e.NewComponent("So?")
+			c.data.(*So).Haha = i
+			c.Save()
+		}
+		if i > 1 && i % 2 == 0 && i != 4 {
+			want[e.id] = true
+		}
+	}
+
+	eq := m.QueryEntities()
+	Gt(eq.With("xyz!"), "X", 1)
+	eq.With("N?")
+	eq.With("So?")
+	ts, err := eq.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.Close()
+	n := 0
+	for ts.Next() {
+		n++
+		e := ts.Entity()
+		if !want[e.id] {
+			t.Error("Unexpected entity", e.id)
+		}
+		cs := ts.Components()
+		if len(cs) != 3 {
+			t.Fatal("Got", len(cs), "components instead of 3")
+		}
+		if cs[0].data.(*Xyz).X != cs[2].data.(*So).Haha || ts.Component("N?").data.(*Nd).N != "even" {
+			t.Error("Got wrong components for entity", e.id)
+		}
+		for _, c := range cs {
+			if c.entity != e.id {
+				t.Error("Component of entity", c.entity, "given for", e.id)
+			}
+		}
+	}
+	if n != len(want) {
+		t.Error("Got", n, "entities instead of", len(want))
+	}
+}
+
+func TestQueryEntitiesInMemory(t *testing.T) {
+	m, _ := NewManagerWithBackend(NewLocalBackend())
+	m.RegisterComponent("xyz!", "", Xyz{}, nil)
+	m.RegisterComponent("N?", "", Nd{}, nil)
+
+	for i := 0; i < 4; i++ {
+		e, _ := m.NewEntity()
+		c, _ := e.NewComponent("xyz!")
+		c.data.(*Xyz).Y = i
+		c.Save()
+		if i != 3 {
+			c, _ = e.NewComponent("N?")
+			c.Save()
+		}
+	}
+
+	eq := m.QueryEntities()
+	Gte(eq.With("xyz!"), "Y", 1)
+	eq.With("N?")
+	ts, err := eq.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ys := make([]int, 0)
+	for ts.Next() {
+		ys = append(ys, ts.Component("xyz!").data.(*Xyz).Y)
+	}
+	if len(ys) != 2 || ys[0] != 1 || ys[1] != 2 {
+		t.Error("Got wrong entities", ys)
+	}
+
+	ts, _ = m.QueryEntities().Run()
+	n := 0
+	for ts.Next() {
+		n++
+	}
+	if n != 4 {
+		t.Error("Got", n, "entities instead of 4")
+	}
+
+	eq = m.QueryEntities()
+	eq.With("Nope")
+	if _, err := eq.Run(); err != ErrComponentNotRegistered {
+		t.Error("Queried unregistered component", err)
+	}
+}
+
+func TestQueryEntitiesWithout(t *testing.T) {
+	m := getEmptyManager()
+	m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
+	m.RegisterComponent("N?", "nd", Nd{}, nil)
+	m.RegisterLocalComponent("So?", So{}, nil)
+
+	// 0: xyz, 1: xyz N, 2: xyz So, 3: nothing
+	ids := make([]int64, 4)
+	for i := 0; i < 4; i++ {
+		e, _ := m.NewEntity()
+		ids[i] = e.id
+		if i < 3 {
+			c, _ := e.NewComponent("xyz!")
+			c.Save()
+		}
+		if i == 1 {
+			c, _ := e.NewComponent("N?")
+			c.Save()
+		}
+		if i == 2 {
+			c, _ := e.NewComponent("So?")
+			c.Save()
+		}
+	}
+
+	entities := func(eq *EntityQuery) []int64 {
+		ts, err := eq.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]int64, 0)
+		for ts.Next() {
+			got = append(got, ts.Entity().id)
+		}
+		return got
+	}
+
+	eq := m.QueryEntities()
+	eq.With("xyz!")
+	eq.Without("N?").Without("So?")
+	if got := entities(eq); len(got) != 1 || got[0] != ids[0] {
+		t.Error("Got", got, "instead of", ids[:1])
+	}
+
+	if got := entities(m.QueryEntities().Without("xyz!")); len(got) != 1 || got[0] != ids[3] {
+		t.Error("Got", got, "instead of", ids[3:])
+	}
+
+	eq = m.QueryEntities()
+	eq.With("So?")
+	eq.Without("N?")
+	if got := entities(eq); len(got) != 1 || got[0] != ids[2] {
+		t.Error("Got", got, "instead of", ids[2:3])
+	}
+
+	if _, err := m.QueryEntities().Without("Nope").Run(); err != ErrComponentNotRegistered {
+		t.Error("Excluded unregistered component", err)
+	}
+}
+
+func TestQueryEntitiesPaging(t *testing.T) {
+	forEachBackend(t, func(m *Manager) {
+		m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
+		m.RegisterLocalComponent("So?", So{}, nil)
+		for x := 1; x <= 5; x++ {
+			e, _ := m.NewEntity()
+			c, _ := e.NewComponent("xyz!")
+			c.data.(*Xyz).X = x
+			c.Save()
+			if x != 4 {
+				c, _ = e.NewComponent("So?")
+				c.Save()
+			}
+		}
+
+		eq := m.QueryEntities()
+		q := eq.With("xyz!")
+		q.OrderBy("X", Desc)
+		q.Limit(2)
+		eq.With("So?")
+		ts, err := eq.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		xs := []int{}
+		for ts.Next() {
+			xs = append(xs, ts.Component("xyz!").data.(*Xyz).X)
+		}
+		ts.Close()
+		// the limit picks 5 and 4, and only 5 has an So?
+		if len(xs) != 1 || xs[0] != 5 {
+			t.Error("Got", xs)
+		}
+	})
+}
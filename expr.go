@@ -0,0 +1,391 @@
+package spellbook
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode/utf8"
+)
+
+// An Expr is a condition on the fields of a component, made of comparisons
+// combined with And, Or and Not. Backends evaluate it the same way, whether
+// in SQL or in memory.
+type Expr struct {
+	// op is "and", "or" or "not" for an expression combining others, or
+	// else the comparison operator
+	op string
+	field string
+	// entity compares the entity ID instead of a field
+	entity bool
+	value interface{}
+	operands []Expr
+}
+
+// Compare is the expression comparing a field with a value, with one of the
+// operators taken by Query.Where: =, !=, <, >, <=, >=, in (with a slice of
+// values), between (with a slice of two), like (with a pattern, see below),
+// prefix (with a string the field has to start with), is null and is not null
+// (with any value). Only pointer fields can be null.
+//
+// In a like pattern % stands for any run of characters, _ for any one
+// character, and a backslash makes the character after it stand for itself.
+// Patterns are matched ignoring the case of ASCII letters; whether other
+// letters match regardless of case depends on the database, and in memory
+// they don't, as in sqlite.
+func Compare(field string, op string, val interface{}) Expr {
+	return Expr{ op: op, field: field, value: val }
+}
+
+// EntityIn matches the components of the given entities.
+func EntityIn(ids ...int64) Expr {
+	return Expr{ op: "in", entity: true, value: ids }
+}
+
+// And matches when all of exprs do, or always if there are none.
+func And(exprs ...Expr) Expr {
+	return Expr{ op: "and", operands: exprs }
+}
+
+// Or matches when any of exprs does, and never if there are none.
+func Or(exprs ...Expr) Expr {
+	return Expr{ op: "or", operands: exprs }
+}
+
+// Not matches when e doesn't.
+func Not(e Expr) Expr {
+	return Expr{ op: "not", operands: []Expr{ e } }
+}
+
+// A FilterError describes why a query can't be filtered as asked.
+type FilterError struct {
+	Component string
+	Field string
+	Op string
+	Problem string
+}
+
+func (e *FilterError) Error() string {
+	return fmt.Sprintf("Can't filter %s by %s %s: %s", e.Component, e.Field, e.Op, e.Problem)
+}
+
+// Check makes sure the expression can filter components of type ctype,
+// returning a *FilterError if not. Backends should refuse expressions which
+// fail it in Query.Filter.
+func (e Expr) Check(ctype *ComponentType) error {
+	return e.check(ctype)
+}
+
+// Match evaluates a checked expression on data, a pointer to entity's
+// component of type ctype, as the backends spellbook comes with do. Like SQL,
+// it treats comparisons with null fields as neither true nor false, so an
+// expression only matches if it is known to be true.
+func (e Expr) Match(ctype *ComponentType, entity int64, data interface{}) bool {
+	return e.match(ctype, entity, reflect.ValueOf(data).Elem())
+}
+
+// check makes sure the expression only uses stored fields of ctype and
+// operators spellbook knows, with values which can be compared with the
+// fields. Only what passes is ever written into SQL.
+func (e Expr) check(ctype *ComponentType) error {
+	switch e.op {
+	case "and", "or", "not":
+		for _, o := range e.operands {
+			if err := o.check(ctype); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	fail := func(problem string, args ...interface{}) error {
+		return &FilterError{ ctype.name, e.field, e.op, fmt.Sprintf(problem, args...) }
+	}
+	var t reflect.Type
+	if e.entity {
+		t = reflect.TypeOf(int64(0))
+	} else if f, ok := ctype.field(e.field); ok {
+		t = ctype.typ.Field(f.index).Type
+	} else {
+		return fail("no such field")
+	}
+	switch e.op {
+	case "is null", "is not null":
+		return nil
+	case "=", "!=", "<", ">", "<=", ">=":
+		if !comparableWith(t, e.value) {
+			return fail("can't compare %s with %T", t, e.value)
+		}
+		return nil
+	case "in", "between":
+		v := reflect.ValueOf(e.value)
+		if k := v.Kind(); k != reflect.Slice && k != reflect.Array {
+			return fail("needs a slice of values, not %T", e.value)
+		}
+		if e.op == "between" && v.Len() != 2 {
+			return fail("needs a slice of two values, not %d", v.Len())
+		}
+		for i := 0; i < v.Len(); i++ {
+			if val := v.Index(i).Interface(); !comparableWith(t, val) {
+				return fail("can't compare %s with %T", t, val)
+			}
+		}
+		return nil
+	case "like", "prefix":
+		if _, ok := e.value.(string); !ok {
+			return fail("needs a string, not %T", e.value)
+		}
+		st := t
+		if st.Kind() == reflect.Ptr {
+			st = st.Elem()
+		}
+		if st.Kind() != reflect.String {
+			return fail("%s isn't a string", t)
+		}
+		if e.op == "like" {
+			pattern := e.value.(string)
+			escapes := len(pattern) - len(strings.TrimRight(pattern, `\`))
+			if escapes % 2 == 1 {
+				return fail("pattern ends with an unescaped backslash")
+			}
+		}
+		return nil
+	}
+	return fail("unsupported operator")
+}
+
+// comparableWith reports whether fields of type t can be compared with val.
+func comparableWith(t reflect.Type, val interface{}) bool {
+	if val == nil {
+		return false
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	_, ok := compareValues(reflect.Zero(t), reflect.ValueOf(val))
+	return ok
+}
+
+// match evaluates the expression on cv, entity's component of type ctype,
+// the way SQL does: comparisons with a null field are unknown rather than
+// true or false, and so is anything depending on them. It returns whether
+// the expression is known to be true.
+func (e Expr) match(ctype *ComponentType, entity int64, cv reflect.Value) bool {
+	result, known := e.eval(ctype, entity, cv)
+	return result && known
+}
+
+func (e Expr) eval(ctype *ComponentType, entity int64, cv reflect.Value) (result bool, known bool) {
+	switch e.op {
+	case "and":
+		known = true
+		for _, o := range e.operands {
+			r, k := o.eval(ctype, entity, cv)
+			if k && !r {
+				return false, true
+			}
+			known = known && k
+		}
+		return known, known
+	case "or":
+		known = true
+		for _, o := range e.operands {
+			r, k := o.eval(ctype, entity, cv)
+			if k && r {
+				return true, true
+			}
+			known = known && k
+		}
+		return false, known
+	case "not":
+		r, k := e.operands[0].eval(ctype, entity, cv)
+		return !r, k
+	}
+	var fv reflect.Value
+	if e.entity {
+		fv = reflect.ValueOf(entity)
+	} else {
+		f, ok := ctype.field(e.field)
+		if !ok {
+			return false, true
+		}
+		fv = cv.Field(f.index)
+	}
+	null := fv.Kind() == reflect.Ptr && fv.IsNil()
+	switch e.op {
+	case "is null":
+		return null, true
+	case "is not null":
+		return !null, true
+	}
+	if null {
+		return false, false
+	}
+	fv = reflect.Indirect(fv)
+	switch e.op {
+	case "in":
+		vals := reflect.ValueOf(e.value)
+		for i := 0; i < vals.Len(); i++ {
+			if c, ok := compareValues(fv, vals.Index(i)); ok && c == 0 {
+				return true, true
+			}
+		}
+		return false, true
+	case "between":
+		vals := reflect.ValueOf(e.value)
+		lo, ok := compareValues(fv, vals.Index(0))
+		hi, ok2 := compareValues(fv, vals.Index(1))
+		if !ok || !ok2 {
+			return false, false
+		}
+		return lo >= 0 && hi <= 0, true
+	case "like":
+		if fv.Kind() != reflect.String {
+			return false, false
+		}
+		return like(lowerASCII(fv.String()), lowerASCII(e.value.(string))), true
+	case "prefix":
+		if fv.Kind() != reflect.String {
+			return false, false
+		}
+		return strings.HasPrefix(fv.String(), e.value.(string)), true
+	}
+	c, ok := compareValues(fv, reflect.ValueOf(e.value))
+	if !ok {
+		return false, false
+	}
+	switch e.op {
+	case "=":
+		return c == 0, true
+	case "!=":
+		return c != 0, true
+	case "<":
+		return c < 0, true
+	case ">":
+		return c > 0, true
+	case "<=":
+		return c <= 0, true
+	case ">=":
+		return c >= 0, true
+	}
+	return false, false
+}
+
+// lowerASCII lowers the case of ASCII letters and leaves the rest, as sqlite's
+// lower does.
+func lowerASCII(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+// like matches s against a SQL like pattern, where % stands for any run of
+// characters, _ for any one character and a backslash escapes the character
+// after it.
+func like(s string, pattern string) bool {
+	if pattern == "" {
+		return s == ""
+	}
+	p, size := utf8.DecodeRuneInString(pattern)
+	switch p {
+	case '%':
+		for i := 0; ; {
+			if like(s[i:], pattern[size:]) {
+				return true
+			}
+			if i == len(s) {
+				return false
+			}
+			_, n := utf8.DecodeRuneInString(s[i:])
+			i += n
+		}
+	case '_':
+		if s == "" {
+			return false
+		}
+		_, n := utf8.DecodeRuneInString(s)
+		return like(s[n:], pattern[size:])
+	case '\\':
+		if len(pattern) > size {
+			pattern = pattern[size:]
+			p, size = utf8.DecodeRuneInString(pattern)
+		}
+	}
+	r, n := utf8.DecodeRuneInString(s)
+	return s != "" && r == p && like(s[n:], pattern[size:])
+}
+
+// compareValues orders a field's value against another, which must be of the
+// same kind of type. Numbers of different kinds are compared by value, and
+// byte slices byte by byte.
+func compareValues(a reflect.Value, b reflect.Value) (int, bool) {
+	if b.Kind() == reflect.Interface {
+		b = b.Elem()
+	}
+	if !a.IsValid() || !b.IsValid() {
+		return 0, false
+	}
+	switch a.Kind() {
+	case reflect.String:
+		if b.Kind() != reflect.String {
+			return 0, false
+		}
+		return order(a.String() < b.String(), a.String() > b.String()), true
+	case reflect.Bool:
+		if b.Kind() != reflect.Bool {
+			return 0, false
+		}
+		return order(!a.Bool() && b.Bool(), a.Bool() && !b.Bool()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if isInt(a) && isInt(b) {
+			return order(a.Int() < b.Int(), a.Int() > b.Int()), true
+		}
+		x, ok := toFloat(a)
+		y, ok2 := toFloat(b)
+		if !ok || !ok2 {
+			return 0, false
+		}
+		return order(x < y, x > y), true
+	case reflect.Slice:
+		// byte slices, compared a byte at a time as databases compare blobs
+		if a.Type().Elem().Kind() != reflect.Uint8 || b.Kind() != reflect.Slice || b.Type().Elem().Kind() != reflect.Uint8 {
+			return 0, false
+		}
+		return bytes.Compare(a.Bytes(), b.Bytes()), true
+	}
+	return 0, false
+}
+
+func order(less bool, greater bool) int {
+	if less {
+		return -1
+	}
+	if greater {
+		return 1
+	}
+	return 0
+}
+
+func isInt(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return true
+	}
+	return false
+}
+
+func toFloat(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,361 @@
+package spellbook
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// xyzsMatching fills m with Xyzs and lists the X of those matching e.
+func xyzsMatching(t *testing.T, m *Manager, table string, e Expr) []int {
+	if err := m.RegisterComponent("xyz!", table, Xyz{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for x := 0; x < 10; x++ {
+		ent, _ := m.NewEntity()
+		c, _ := ent.NewComponent("xyz!")
+		c.data.(*Xyz).X = x
+		c.data.(*Xyz).Y = x % 3
+		c.Save()
+	}
+	q := m.QueryComponent("xyz!")
+	q.Filter(e)
+	cs, err := q.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	xs := make([]int, 0)
+	for cs.Next() {
+		xs = append(xs, cs.Component().data.(*Xyz).X)
+	}
+	sort.Ints(xs)
+	return xs
+}
+
+func TestExprsMatchAlike(t *testing.T) {
+	exprs := []Expr{
+		Or(Compare("X", "<", 2), Compare("X", ">", 7)),
+		And(Compare("Y", "=", 0), Not(Compare("X", "=", 3))),
+		Not(Or(Compare("Y", "=", 1), And(Compare("X", ">=", 4), Compare("X", "<=", 6)))),
+		Or(),
+		And(),
+	}
+	expected := [][]int{
+		{ 0, 1, 8, 9 },
+		{ 0, 6, 9 },
+		{ 0, 2, 3, 8, 9 },
+		{},
+		{ 0, 1, 2, 3, 4, 5, 6, 7, 8, 9 },
+	}
+	for i, e := range exprs {
+		forEachBackend(t, func(m *Manager) {
+			xs := xyzsMatching(t, m, "xyz", e)
+			if len(xs) != len(expected[i]) {
+				t.Error("Expression", i, "matched", xs, "instead of", expected[i])
+				return
+			}
+			for j := range xs {
+				if xs[j] != expected[i][j] {
+					t.Error("Expression", i, "matched", xs, "instead of", expected[i])
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestExprSQL(t *testing.T) {
+	m := getEmptyManager()
+	m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
+	q := m.QueryComponent("xyz!")
+	Gt(q, "Z", 0)
+	q.Filter(Or(Compare("X", "=", 1), Not(Compare("Y", "<", 2))))
+	expected := `select "entity_id", "X", "Y", "Z" from "xyz" where "Z" > ? and ("X" = ? or not "Y" < ?)`
+	if s, args, _ := q.(*dbQuery).statement(); s != expected || len(args) != 3 {
+		t.Error("Wrong query:", s, args)
+	}
+}
+
+type Named struct {
+	Name string
+	Score *int
+}
+
+// namesMatching fills m with Nameds and lists the names of those matching
+// the conditions added by where.
+func namesMatching(t *testing.T, m *Manager, where func(q Query)) []string {
+	if err := m.RegisterComponent("named", "named", Named{}, nil, AutoCreate()); err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{ "Alice", "alfred", "Bob", "carol", "Dave" } {
+		e, _ := m.NewEntity()
+		c, _ := e.NewComponent("named")
+		n := c.data.(*Named)
+		n.Name = name
+		if i != 2 {
+			score := i * 10
+			n.Score = &score
+		}
+		if err := c.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q := m.QueryComponent("named")
+	where(q)
+	cs, err := q.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	names := make([]string, 0)
+	for cs.Next() {
+		names = append(names, cs.Component().data.(*Named).Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestOperatorsMatchAlike(t *testing.T) {
+	wheres := []func(q Query){
+		func(q Query) { In(q, "Name", []string{ "Bob", "Dave", "Eve" }) },
+		func(q Query) { In(q, "Score", []int{}) },
+		func(q Query) { Between(q, "Score", 10, 30) },
+		func(q Query) { Like(q, "Name", "al%") },
+		func(q Query) { Like(q, "Name", "_a%e") },
+		func(q Query) { Like(q, "Name", "a\\%") },
+		func(q Query) { Like(q, "Name", "%\\e") },
+		func(q Query) { HasPrefix(q, "Name", "Al") },
+		func(q Query) { IsNull(q, "Score") },
+		func(q Query) { NotNull(q, "Score"); Lt(q, "Score", 20) },
+		func(q Query) { q.Filter(Not(Compare("Score", "=", 0))) },
+	}
+	expected := [][]string{
+		{ "Bob", "Dave" },
+		{},
+		{ "alfred", "carol" },
+		{ "Alice", "alfred" },
+		{ "Dave" },
+		{},
+		{ "Alice", "Dave" },
+		{ "Alice" },
+		{ "Bob" },
+		{ "Alice", "alfred" },
+		{ "Dave", "alfred", "carol" },
+	}
+	for i, where := range wheres {
+		forEachBackend(t, func(m *Manager) {
+			names := namesMatching(t, m, where)
+			if len(names) != len(expected[i]) {
+				t.Error("Condition", i, "matched", names, "instead of", expected[i])
+				return
+			}
+			for j := range names {
+				if names[j] != expected[i][j] {
+					t.Error("Condition", i, "matched", names, "instead of", expected[i])
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestUnsupportedOperator(t *testing.T) {
+	forEachBackend(t, func(m *Manager) {
+		m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
+		q := m.QueryComponent("xyz!")
+		q.Where("X", 1, "~")
+		if _, err := q.Run(); err == nil {
+			t.Error("Ran query with unsupported operator")
+		}
+		q = m.QueryComponent("xyz!")
+		Between(q, "X", 1, 2)
+		q.Where("Y", 3, "between")
+		if _, err := q.Run(); err == nil {
+			t.Error("Ran between without two values")
+		}
+	})
+}
+
+func TestUnknownFieldsRejected(t *testing.T) {
+	forEachBackend(t, func(m *Manager) {
+		m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
+		e, _ := m.NewEntity()
+		c, _ := e.NewComponent("xyz!")
+		c.Save()
+
+		for _, field := range []string{ "W", "1 = 1 or X", `"X"`, "x" } {
+			q := m.QueryComponent("xyz!")
+			Eq(q, field, 0)
+			if _, err := q.Run(); err == nil {
+				t.Errorf("Ran query on field %q", field)
+			}
+		}
+		q := m.QueryComponent("xyz!")
+		q.Where("X", 0, "= 0 or 1 =")
+		if _, err := q.Run(); err == nil {
+			t.Error("Ran query with operator smuggling SQL")
+		}
+		q = m.QueryComponent("xyz!")
+		q.Filter(Or(Compare("X", "=", 0), Not(Compare("Nope", "=", 0))))
+		if _, err := q.Run(); err == nil {
+			t.Error("Ran query on field nested in expression")
+		}
+	})
+}
+
+func TestWhereErrors(t *testing.T) {
+	forEachBackend(t, func(m *Manager) {
+		m.RegisterComponent("N?", "nd", Nd{}, nil)
+		m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
+
+		q := m.QueryComponent("N?")
+		err := Lt(q, "N", 5)
+		fe, ok := err.(*FilterError)
+		if !ok || fe.Component != "N?" || fe.Field != "N" || fe.Op != "<" {
+			t.Fatal("Got", err, "comparing string with int")
+		}
+		if err := Eq(q, "N", "fine"); err != fe {
+			t.Error("Later Where didn't return first error", err)
+		}
+		if _, err := q.Run(); err != fe {
+			t.Error("Run returned", err, "instead of", fe)
+		}
+		if _, err := q.Count(); err != fe {
+			t.Error("Count returned", err, "instead of", fe)
+		}
+
+		q = m.QueryComponent("xyz!")
+		if err := Gt(q, "X", 2.5); err != nil {
+			t.Error("Comparing int with float:", err)
+		}
+		if err := In(q, "Y", []interface{}{ 1, "two" }); err == nil {
+			t.Error("Compared int with string in list")
+		}
+		if err := Like(m.QueryComponent("xyz!"), "X", "1%"); err == nil {
+			t.Error("Matched pattern against int")
+		}
+		if err := Eq(m.QueryComponent("xyz!"), "X", nil); err == nil {
+			t.Error("Compared with nil")
+		}
+	})
+}
+
+func TestEntityIn(t *testing.T) {
+	forEachBackend(t, func(m *Manager) {
+		m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
+		tx, _ := m.Begin()
+		ids := make([]int64, 0)
+		for x := 0; x < 1200; x++ {
+			e, _ := tx.NewEntity()
+			if x % 2 == 0 {
+				c, _ := e.NewComponent("xyz!")
+				c.data.(*Xyz).X = x
+				c.Save()
+			}
+			if x % 3 == 0 {
+				ids = append(ids, e.id)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		q := m.QueryComponent("xyz!")
+		if err := q.Filter(EntityIn(ids...)); err != nil {
+			t.Fatal(err)
+		}
+		Lt(q, "X", 1000)
+		if n, err := q.Count(); err != nil || n != 167 {
+			t.Error("Got", n, "components instead of 167", err)
+		}
+
+		es, _ := m.GetEntities()
+		all, err := es.IDs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+		q = m.QueryComponent("xyz!")
+		q.Filter(EntityIn(all[:10]...))
+		if n, err := q.Count(); err != nil || n != 5 {
+			t.Error("Got", n, "components instead of 5", err)
+		}
+	})
+}
+
+func TestLikeFoldsOnlyASCII(t *testing.T) {
+	forEachBackend(t, func(m *Manager) {
+		m.RegisterComponent("nd", "nd", Nd{}, nil)
+		for _, n := range []string{ "ÉCOLE", "Ecole" } {
+			e, _ := m.NewEntity()
+			c, _ := e.NewComponent("nd")
+			c.data.(*Nd).N = n
+			c.Save()
+		}
+		patterns := map[string]int{ "école": 0, "ÉCOLE": 1, "ecole": 1, "%COLE": 2 }
+		for pattern, expected := range patterns {
+			q := m.QueryComponent("nd")
+			Like(q, "N", pattern)
+			if n, err := q.Count(); err != nil || n != int64(expected) {
+				t.Error(pattern, "matched", n, "instead of", expected, err)
+			}
+		}
+
+		if err := Like(m.QueryComponent("nd"), "N", `Ecole\`); err == nil {
+			t.Error("Accepted a pattern ending with a backslash")
+		}
+	})
+}
+
+type Blob struct {
+	Data []byte
+}
+
+func TestBlobComparisons(t *testing.T) {
+	forEachBackend(t, func(m *Manager) {
+		if err := m.RegisterComponent("blob", "blob", Blob{}, nil, AutoCreate()); err != nil {
+			t.Fatal(err)
+		}
+		for _, data := range []string{ "b", "ab", "a", "b\x00" } {
+			e, _ := m.NewEntity()
+			c, _ := e.NewComponent("blob")
+			c.data.(*Blob).Data = []byte(data)
+			c.Save()
+		}
+		datas := func(q Query) []string {
+			cs, err := q.Run()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cs.Close()
+			ds := make([]string, 0)
+			for cs.Next() {
+				ds = append(ds, string(cs.Component().data.(*Blob).Data))
+			}
+			return ds
+		}
+
+		q := m.QueryComponent("blob")
+		Eq(q, "Data", []byte("ab"))
+		if ds := datas(q); !reflect.DeepEqual(ds, []string{ "ab" }) {
+			t.Errorf("Eq found %q instead of [ab]", ds)
+		}
+		q = m.QueryComponent("blob")
+		In(q, "Data", [][]byte{ []byte("a"), []byte("b") })
+		if ds := datas(q); !reflect.DeepEqual(ds, []string{ "b", "a" }) {
+			t.Errorf("In found %q instead of [b a]", ds)
+		}
+		q = m.QueryComponent("blob")
+		Gt(q, "Data", []byte("ab"))
+		q.OrderBy("Data", Desc)
+		if ds := datas(q); !reflect.DeepEqual(ds, []string{ "b\x00", "b" }) {
+			t.Errorf("Gt found %q instead of [b\\x00 b]", ds)
+		}
+		q = m.QueryComponent("blob")
+		q.OrderBy("Data", Asc)
+		if ds := datas(q); !reflect.DeepEqual(ds, []string{ "a", "ab", "b", "b\x00" }) {
+			t.Errorf("Ordered %q instead of [a ab b b\\x00]", ds)
+		}
+	})
+}
@@ -0,0 +1,726 @@
+package spellbook
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// A FileBackend keeps entities and components in a single file of its own,
+// for embedded use without a database. Everything is held in memory while
+// the file is open.
+//
+// The file starts with a base segment storing each type of component in
+// columns alongside an index of the entities owning each row. Every change is
+// then appended to the file as a log record, which is synced to disk before
+// the change takes effect. A crash can only lose the record being written, and
+// the torn record is dropped when the file is next opened. Compact folds the
+// log back into a fresh base segment.
+type FileBackend struct {
+	mu sync.Mutex
+	path string
+	f *os.File
+	nextID int64
+	entities map[int64]bool
+	tables map[string]*fileTable
+}
+
+// fileTable holds the components of one type. Components of types not
+// registered since the file was opened are kept as raw column values, so
+// they survive compaction.
+type fileTable struct {
+	ctype *ComponentType
+	rows map[int64]interface{}
+	raw map[int64]map[string]interface{}
+}
+
+const fileMagic = "SPELLBK1"
+
+const (
+	recordBase byte = 'S'
+	recordLog byte = 'L'
+)
+
+const (
+	opNewEntity byte = iota
+	opDeleteEntity
+	opSave
+	opRemove
+)
+
+type fileColumn struct {
+	Name string
+	Values []interface{}
+}
+
+type fileSegment struct {
+	Component string
+	Entities []int64
+	Columns []fileColumn
+}
+
+type fileBase struct {
+	NextID int64
+	Entities []int64
+	Segments []fileSegment
+}
+
+type fileOp struct {
+	Kind byte
+	Entity int64
+	Component string
+	Columns []string
+	Values []interface{}
+}
+
+// OpenFileBackend opens or creates the file at path.
+func OpenFileBackend(path string) (*FileBackend, error) {
+	b := &FileBackend{ path: path, entities: make(map[int64]bool), tables: make(map[string]*fileTable) }
+	f, err := os.OpenFile(path, os.O_RDWR | os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	b.f = f
+	if err := b.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func encodeRecord(kind byte, v interface{}) ([]byte, error) {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(v); err != nil {
+		return nil, err
+	}
+	rec := make([]byte, 9, 9 + payload.Len())
+	rec[0] = kind
+	binary.LittleEndian.PutUint32(rec[1:5], uint32(payload.Len()))
+	binary.LittleEndian.PutUint32(rec[5:9], crc32.ChecksumIEEE(payload.Bytes()))
+	return append(rec, payload.Bytes()...), nil
+}
+
+// readRecord reads one record, returning io.ErrUnexpectedEOF for a record cut
+// short or failing its checksum.
+func readRecord(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(header[1:5]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(header[5:9]) {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	return header[0], payload, nil
+}
+
+// load reads the file, writing the header of a new one, and truncates any
+// torn record at its end.
+func (b *FileBackend) load() error {
+	info, err := b.f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return b.writeFile(b.f)
+	}
+	r := bufio.NewReader(b.f)
+	magic := make([]byte, len(fileMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != fileMagic {
+		return fmt.Errorf("%s is not a spellbook file", b.path)
+	}
+	offset := int64(len(fileMagic))
+	for {
+		kind, payload, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			if err := b.f.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		dec := gob.NewDecoder(bytes.NewReader(payload))
+		switch kind {
+		case recordBase:
+			var base fileBase
+			if err := dec.Decode(&base); err != nil {
+				return err
+			}
+			b.loadBase(base)
+		case recordLog:
+			var ops []fileOp
+			if err := dec.Decode(&ops); err != nil {
+				return err
+			}
+			for _, op := range ops {
+				if err := b.apply(op); err != nil {
+					return err
+				}
+			}
+		default:
+			return fmt.Errorf("Unknown record type %q in %s", kind, b.path)
+		}
+		offset += int64(9 + len(payload))
+	}
+	_, err = b.f.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (b *FileBackend) table(name string) *fileTable {
+	t, ok := b.tables[name]
+	if !ok {
+		t = &fileTable{ rows: make(map[int64]interface{}), raw: make(map[int64]map[string]interface{}) }
+		b.tables[name] = t
+	}
+	return t
+}
+
+func (b *FileBackend) loadBase(base fileBase) {
+	b.nextID = base.NextID
+	for _, id := range base.Entities {
+		b.entities[id] = true
+	}
+	for _, seg := range base.Segments {
+		t := b.table(seg.Component)
+		for i, id := range seg.Entities {
+			values := make(map[string]interface{})
+			for _, col := range seg.Columns {
+				values[col.Name] = col.Values[i]
+			}
+			t.raw[id] = values
+		}
+	}
+}
+
+// decode builds a component from its column values.
+func (t *fileTable) decode(values map[string]interface{}) (interface{}, error) {
+	cv := reflect.New(t.ctype.typ).Elem()
+	for _, f := range t.ctype.fields {
+		v, ok := values[f.column]
+		if !ok {
+			continue
+		}
+		if err := setField(cv.Field(f.index), reflect.ValueOf(v)); err != nil {
+			return nil, fmt.Errorf("Field %s of %s: %s", f.name, t.ctype.name, err)
+		}
+	}
+	return cv.Addr().Interface(), nil
+}
+
+// encode lists a component's column names and values.
+func (t *fileTable) encode(data interface{}) ([]string, []interface{}) {
+	cv := reflect.ValueOf(data).Elem()
+	columns := make([]string, len(t.ctype.fields))
+	values := make([]interface{}, len(t.ctype.fields))
+	for i, f := range t.ctype.fields {
+		columns[i] = f.column
+		values[i] = builtinValue(fieldValue(cv.Field(f.index)))
+	}
+	return columns, values
+}
+
+// builtinValue converts a field value of a named type, such as Level in
+// type Level int, to the builtin type underlying it, since gob can only encode
+// values of types it has been told about.
+func builtinValue(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return rv.Uint()
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	case reflect.Bool:
+		return rv.Bool()
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return rv.Bytes()
+		}
+	}
+	return v
+}
+
+func (b *FileBackend) apply(op fileOp) error {
+	switch op.Kind {
+	case opNewEntity:
+		b.entities[op.Entity] = true
+		if op.Entity > b.nextID {
+			b.nextID = op.Entity
+		}
+	case opDeleteEntity:
+		delete(b.entities, op.Entity)
+		// including components of types not registered this time
+		for _, t := range b.tables {
+			delete(t.rows, op.Entity)
+			delete(t.raw, op.Entity)
+		}
+	case opSave:
+		t := b.table(op.Component)
+		values := make(map[string]interface{})
+		for i, col := range op.Columns {
+			values[col] = op.Values[i]
+		}
+		if t.ctype == nil {
+			t.raw[op.Entity] = values
+			return nil
+		}
+		data, err := t.decode(values)
+		if err != nil {
+			return err
+		}
+		t.rows[op.Entity] = data
+	case opRemove:
+		t := b.table(op.Component)
+		delete(t.rows, op.Entity)
+		delete(t.raw, op.Entity)
+	}
+	return nil
+}
+
+// write appends ops to the log as one record and syncs it to disk.
+func (b *FileBackend) write(ops ...fileOp) error {
+	rec, err := encodeRecord(recordLog, ops)
+	if err != nil {
+		return err
+	}
+	offset, err := b.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := b.f.Write(rec); err != nil {
+		// don't leave a torn record for later ones to be appended after
+		b.f.Truncate(offset)
+		b.f.Seek(offset, io.SeekStart)
+		return err
+	}
+	return b.f.Sync()
+}
+
+// commit appends ops to the log and applies them once they are safely on
+// disk.
+func (b *FileBackend) commit(ops ...fileOp) error {
+	if err := b.write(ops...); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if err := b.apply(op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// change makes a change straight away, or as part of tx if it isn't nil.
+func (b *FileBackend) change(tx *fileTx, op fileOp) error {
+	if tx == nil {
+		return b.commit(op)
+	}
+	tx.undo = append(tx.undo, b.undoer(op))
+	tx.ops = append(tx.ops, op)
+	return b.apply(op)
+}
+
+// undoer returns a function putting back what op is about to change.
+func (b *FileBackend) undoer(op fileOp) func() {
+	switch op.Kind {
+	case opNewEntity, opDeleteEntity:
+		existed := b.entities[op.Entity]
+		undo := []func(){}
+		if op.Kind == opDeleteEntity {
+			for _, t := range b.tables {
+				undo = append(undo, t.undoer(op.Entity))
+			}
+		}
+		return func() {
+			if existed {
+				b.entities[op.Entity] = true
+			} else {
+				delete(b.entities, op.Entity)
+			}
+			for _, f := range undo {
+				f()
+			}
+		}
+	}
+	return b.table(op.Component).undoer(op.Entity)
+}
+
+// undoer returns a function putting back the entity's row as it is now.
+func (t *fileTable) undoer(entity int64) func() {
+	row, hasRow := t.rows[entity]
+	raw, hasRaw := t.raw[entity]
+	return func() {
+		delete(t.rows, entity)
+		delete(t.raw, entity)
+		if hasRow {
+			t.rows[entity] = row
+		}
+		if hasRaw {
+			t.raw[entity] = raw
+		}
+	}
+}
+
+// base gathers everything into a base segment, component types sorted by
+// name and rows by entity so that compacting is deterministic.
+func (b *FileBackend) base() fileBase {
+	base := fileBase{ NextID: b.nextID }
+	for id, _ := range b.entities {
+		base.Entities = append(base.Entities, id)
+	}
+	sort.Slice(base.Entities, func(i, j int) bool { return base.Entities[i] < base.Entities[j] })
+	names := []string{}
+	for name, _ := range b.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t := b.tables[name]
+		values := make(map[int64]map[string]interface{})
+		for id, raw := range t.raw {
+			values[id] = raw
+		}
+		for id, data := range t.rows {
+			columns, vals := t.encode(data)
+			values[id] = make(map[string]interface{})
+			for i, col := range columns {
+				values[id][col] = vals[i]
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+		seg := fileSegment{ Component: name }
+		for id, _ := range values {
+			seg.Entities = append(seg.Entities, id)
+		}
+		sort.Slice(seg.Entities, func(i, j int) bool { return seg.Entities[i] < seg.Entities[j] })
+		columns := make(map[string]bool)
+		for _, vals := range values {
+			for col, _ := range vals {
+				columns[col] = true
+			}
+		}
+		colNames := []string{}
+		for col, _ := range columns {
+			colNames = append(colNames, col)
+		}
+		sort.Strings(colNames)
+		for _, col := range colNames {
+			fc := fileColumn{ Name: col, Values: make([]interface{}, len(seg.Entities)) }
+			for i, id := range seg.Entities {
+				fc.Values[i] = values[id][col]
+			}
+			seg.Columns = append(seg.Columns, fc)
+		}
+		base.Segments = append(base.Segments, seg)
+	}
+	return base
+}
+
+// writeFile writes the header and a base segment of everything to f.
+func (b *FileBackend) writeFile(f *os.File) error {
+	rec, err := encodeRecord(recordBase, b.base())
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append([]byte(fileMagic), rec...)); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Compact rewrites the file as a single base segment, dropping the log. The
+// new file replaces the old one only once it is completely written.
+func (b *FileBackend) Compact() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tmp, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path) + ".compact")
+	if err != nil {
+		return err
+	}
+	if err := b.writeFile(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	// CreateTemp makes files only their owner can read
+	info, err := b.f.Stat()
+	if err == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), b.path); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(b.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	b.f.Close()
+	b.f = tmp
+	return nil
+}
+
+// Close closes the file.
+func (b *FileBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.f.Close()
+}
+
+func (b *FileBackend) NewEntity() (int64, error) {
+	return b.newEntity(nil)
+}
+
+func (b *FileBackend) newEntity(tx *fileTx) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := b.nextID + 1
+	if err := b.change(tx, fileOp{ Kind: opNewEntity, Entity: id }); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+func (b *FileBackend) DeleteEntity(id int64) error {
+	return b.deleteEntity(nil, id)
+}
+
+func (b *FileBackend) deleteEntity(tx *fileTx, id int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.change(tx, fileOp{ Kind: opDeleteEntity, Entity: id })
+}
+
+func (b *FileBackend) Entities() (IDs, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ids := make([]int64, 0, len(b.entities))
+	for id, _ := range b.entities {
+		ids = append(ids, id)
+	}
+	return &sliceIDs{ ids, -1 }, nil
+}
+
+func (b *FileBackend) HasEntity(id int64) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.entities[id], nil
+}
+
+func (b *FileBackend) Register(ctype *ComponentType) error {
+	for _, f := range ctype.fields {
+		if _, err := columnType(ctype.typ.Field(f.index).Type); err != nil {
+			return fmt.Errorf("Field %s: %s", f.name, err)
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.table(ctype.name)
+	if t.ctype != nil {
+		return ErrComponentAlreadyRegistered
+	}
+	t.ctype = ctype
+	for id, values := range t.raw {
+		data, err := t.decode(values)
+		if err != nil {
+			t.ctype = nil
+			t.rows = make(map[int64]interface{})
+			return err
+		}
+		t.rows[id] = data
+	}
+	t.raw = make(map[int64]map[string]interface{})
+	return nil
+}
+
+// clone copies a component so that callers can't change stored components
+// without saving them. What pointer fields point to is copied too.
+func clone(data interface{}) interface{} {
+	v := reflect.ValueOf(data).Elem()
+	c := reflect.New(v.Type())
+	c.Elem().Set(v)
+	for i := 0; i < v.NumField(); i++ {
+		f := c.Elem().Field(i)
+		if f.Kind() == reflect.Ptr && !f.IsNil() && f.CanSet() {
+			p := reflect.New(f.Type().Elem())
+			p.Elem().Set(f.Elem())
+			f.Set(p)
+		}
+	}
+	return c.Interface()
+}
+
+func (b *FileBackend) Get(ctype *ComponentType, entity int64) (interface{}, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, ok := b.table(ctype.name).rows[entity]
+	if !ok {
+		return nil, ErrNoComponent
+	}
+	return clone(data), nil
+}
+
+func (b *FileBackend) Save(ctype *ComponentType, entity int64, data interface{}, isNew bool) error {
+	return b.save(nil, ctype, entity, data, isNew)
+}
+
+func (b *FileBackend) save(tx *fileTx, ctype *ComponentType, entity int64, data interface{}, isNew bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.table(ctype.name)
+	if _, ok := t.rows[entity]; ok && isNew {
+		return ErrDuplicateComponent
+	}
+	columns, values := t.encode(data)
+	return b.change(tx, fileOp{ Kind: opSave, Entity: entity, Component: ctype.name, Columns: columns, Values: values })
+}
+
+func (b *FileBackend) Remove(ctype *ComponentType, entity int64) error {
+	return b.remove(nil, ctype, entity)
+}
+
+func (b *FileBackend) remove(tx *fileTx, ctype *ComponentType, entity int64) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.table(ctype.name).rows[entity]; !ok {
+		return ErrNoComponent
+	}
+	return b.change(tx, fileOp{ Kind: opRemove, Entity: entity, Component: ctype.name })
+}
+
+// Move logs the component's removal from one entity and saving on the other
+// as a single record.
+func (b *FileBackend) Move(ctype *ComponentType, from, to int64, data interface{}) error {
+	return b.move(nil, ctype, from, to, data)
+}
+
+func (b *FileBackend) move(tx *fileTx, ctype *ComponentType, from, to int64, data interface{}) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := b.table(ctype.name)
+	if _, ok := t.rows[from]; !ok {
+		return ErrNoComponent
+	}
+	columns, values := t.encode(data)
+	ops := []fileOp{
+		{ Kind: opRemove, Entity: from, Component: ctype.name },
+		{ Kind: opSave, Entity: to, Component: ctype.name, Columns: columns, Values: values },
+	}
+	if tx == nil {
+		return b.commit(ops...)
+	}
+	for _, op := range ops {
+		if err := b.change(tx, op); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query runs over a copy of the components taken each time the query runs,
+// so that it sees what was saved before then.
+func (b *FileBackend) Query(m *Manager, ctype *ComponentType) Query {
+	return NewMemoryQuery(m, ctype, func() map[int64]interface{} {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		data := make(map[int64]interface{})
+		for id, c := range b.table(ctype.name).rows {
+			data[id] = c
+		}
+		return data
+	})
+}
+
+// Begin starts a transaction. Its changes are seen straight away, but only
+// reach the file as a single log record on Commit. Other changes shouldn't be
+// made, nor the file compacted, while it is open.
+func (b *FileBackend) Begin() (BackendTx, error) {
+	return &fileTx{ FileBackend: b }, nil
+}
+
+type fileTx struct {
+	*FileBackend
+	ops []fileOp
+	undo []func()
+}
+
+func (tx *fileTx) Begin() (BackendTx, error) {
+	return nil, ErrNestedTx
+}
+
+func (tx *fileTx) NewEntity() (int64, error) {
+	return tx.newEntity(tx)
+}
+
+func (tx *fileTx) DeleteEntity(id int64) error {
+	return tx.deleteEntity(tx, id)
+}
+
+func (tx *fileTx) Save(ctype *ComponentType, entity int64, data interface{}, isNew bool) error {
+	return tx.save(tx, ctype, entity, data, isNew)
+}
+
+func (tx *fileTx) Remove(ctype *ComponentType, entity int64) error {
+	return tx.remove(tx, ctype, entity)
+}
+
+func (tx *fileTx) Move(ctype *ComponentType, from, to int64, data interface{}) error {
+	return tx.move(tx, ctype, from, to, data)
+}
+
+func (tx *fileTx) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if len(tx.ops) > 0 {
+		if err := tx.write(tx.ops...); err != nil {
+			tx.rollback()
+			return err
+		}
+	}
+	tx.ops = nil
+	tx.undo = nil
+	return nil
+}
+
+func (tx *fileTx) Rollback() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.rollback()
+	return nil
+}
+
+func (tx *fileTx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.ops = nil
+	tx.undo = nil
+}
@@ -0,0 +1,290 @@
+package spellbook
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openFileManager(t *testing.T, path string) (*Manager, *FileBackend) {
+	b, err := OpenFileBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, _ := NewManagerWithBackend(b)
+	if err := m.RegisterComponent("xyz!", "", Xyz{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	return m, b
+}
+
+func TestFileBackendPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.spellbook")
+
+	m, b := openFileManager(t, path)
+	m.RegisterComponent("N?", "", Nd{}, nil)
+	e, _ := m.NewEntity()
+	c, _ := e.NewComponent("xyz!")
+	c.data.(*Xyz).X = 5
+	c.Save()
+	c, _ = e.NewComponent("N?")
+	c.data.(*Nd).N = "kept"
+	c.Save()
+	gone, _ := m.NewEntity()
+	gone.Delete()
+
+	c, _ = e.GetComponent("xyz!")
+	c.data.(*Xyz).Y = 9
+	b.Close()
+
+	for i := 0; i < 2; i++ {
+		// N? isn't registered this time, but must survive compaction
+		m, b = openFileManager(t, path)
+		es, _ := m.GetEntities()
+		n := 0
+		for es.Next() {
+			n++
+		}
+		if n != 1 {
+			t.Error("Got", n, "entities instead of 1")
+		}
+		if ok, err := m.EntityExists(gone.ID()); err != nil || ok {
+			t.Error("Deleted entity exists", err)
+		}
+		found, err := m.Entity(e.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := found.GetComponent("xyz!")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if xyz := got.data.(*Xyz); xyz.X != 5 || xyz.Y != 0 {
+			t.Error("Retrieved wrong data", xyz)
+		}
+		if err := b.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		b.Close()
+	}
+
+	m, b = openFileManager(t, path)
+	defer b.Close()
+	m.RegisterComponent("N?", "", Nd{}, nil)
+	got, err := (&Entity{ e.id, m }).GetComponent("N?")
+	if err != nil || got.data.(*Nd).N != "kept" {
+		t.Error("Lost unregistered component during compaction", got, err)
+	}
+	e2, _ := m.NewEntity()
+	if e2.id == e.id || e2.id == gone.id {
+		t.Error("Reused an entity ID", e2.id)
+	}
+}
+
+type Level int
+type Title string
+
+type Ranked struct {
+	Title Title
+	Level Level
+	Boost *Level
+}
+
+func TestFileBackendNamedFieldTypes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.spellbook")
+
+	m, b := openFileManager(t, path)
+	if err := m.RegisterComponent("ranked", "", Ranked{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	e, _ := m.NewEntity()
+	c, _ := e.NewComponent("ranked")
+	boost := Level(2)
+	*c.data.(*Ranked) = Ranked{ "knight", 3, &boost }
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	for i := 0; i < 2; i++ {
+		m, b = openFileManager(t, path)
+		m.RegisterComponent("ranked", "", Ranked{}, nil)
+		got, err := (&Entity{ e.id, m }).GetComponent("ranked")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r := got.data.(*Ranked); r.Title != "knight" || r.Level != 3 || r.Boost == nil || *r.Boost != 2 {
+			t.Error("Retrieved wrong data", r)
+		}
+		if err := b.Compact(); err != nil {
+			t.Fatal(err)
+		}
+		b.Close()
+	}
+}
+
+func TestFileBackendCompactKeepsMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.spellbook")
+
+	_, b := openFileManager(t, path)
+	defer b.Close()
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Error("Compacting changed the file's mode to", info.Mode().Perm())
+	}
+}
+
+func TestFileBackendDeletesUnregisteredComponents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.spellbook")
+
+	m, b := openFileManager(t, path)
+	m.RegisterComponent("N?", "", Nd{}, nil)
+	e, _ := m.NewEntity()
+	c, _ := e.NewComponent("N?")
+	c.data.(*Nd).N = "orphan"
+	c.Save()
+	b.Close()
+
+	// N? isn't registered, so only the backend knows e has one
+	m, b = openFileManager(t, path)
+	tx, err := m.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.In(tx).Delete()
+	tx.Rollback()
+	if raw := b.table("N?").raw[e.id]; raw == nil {
+		t.Error("Rolling back didn't restore the component")
+	}
+	if _, err := (&Entity{ e.id, m }).Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	m, b = openFileManager(t, path)
+	defer b.Close()
+	m.RegisterComponent("N?", "", Nd{}, nil)
+	if _, err := (&Entity{ e.id, m }).GetComponent("N?"); err != ErrNoComponent {
+		t.Error("Component outlived its entity:", err)
+	}
+}
+
+func TestFileBackendDropsTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.spellbook")
+
+	m, b := openFileManager(t, path)
+	e, _ := m.NewEntity()
+	c, _ := e.NewComponent("xyz!")
+	c.data.(*Xyz).Z = 7
+	c.Save()
+	b.Close()
+
+	// a crash halfway through appending a record
+	f, _ := os.OpenFile(path, os.O_WRONLY | os.O_APPEND, 0666)
+	f.Write([]byte{recordLog, 200, 0, 0, 0, 1, 2, 3, 4, 5})
+	f.Close()
+
+	m, b = openFileManager(t, path)
+	c, err := (&Entity{ e.id, m }).GetComponent("xyz!")
+	if err != nil || c.data.(*Xyz).Z != 7 {
+		t.Fatal("Lost data before the torn record", c, err)
+	}
+	e2, _ := m.NewEntity()
+	b.Close()
+
+	m, b = openFileManager(t, path)
+	defer b.Close()
+	es, _ := m.GetEntities()
+	n := 0
+	for es.Next() {
+		n++
+	}
+	if n != 2 {
+		t.Error("Got", n, "entities instead of 2 after writing past a torn record", e2.id)
+	}
+}
+
+func TestFileBackendQueries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.spellbook")
+	m, b := openFileManager(t, path)
+	defer b.Close()
+
+	for i := 0; i < 4; i++ {
+		e, _ := m.NewEntity()
+		c, _ := e.NewComponent("xyz!")
+		c.data.(*Xyz).X = i
+		c.Save()
+	}
+	q := m.QueryComponent("xyz!")
+	Gte(q, "X", 2)
+	cs, err := q.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for cs.Next() {
+		n++
+		// changing results must not change what's stored
+		cs.Component().data.(*Xyz).X = -1
+	}
+	if n != 2 {
+		t.Error("Got", n, "components instead of 2")
+	}
+	q = m.QueryComponent("xyz!")
+	Lt(q, "X", 0)
+	cs, _ = q.Run()
+	if cs.Next() {
+		t.Error("Changed a stored component without saving it")
+	}
+
+	// the query sees components saved after it was made
+	q = m.QueryComponent("xyz!")
+	Gte(q, "X", 10)
+	e, _ := m.NewEntity()
+	c, _ := e.NewComponent("xyz!")
+	c.data.(*Xyz).X = 10
+	c.Save()
+	if n, err := q.Count(); err != nil || n != 1 {
+		t.Error("Counted", n, "components saved after making the query", err)
+	}
+}
+
+func TestFileBackendMove(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.spellbook")
+	m, b := openFileManager(t, path)
+	e1, _ := m.NewEntity()
+	e2, _ := m.NewEntity()
+	c, _ := e1.NewComponent("xyz!")
+	c.data.(*Xyz).X = 4
+	c.Save()
+	c.data.(*Xyz).Y = 6
+	if err := c.MoveTo(e2); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	m, b = openFileManager(t, path)
+	defer b.Close()
+	if _, err := (&Entity{ e1.id, m }).GetComponent("xyz!"); err != ErrNoComponent {
+		t.Error("Component not missing after moving", err)
+	}
+	c, err := (&Entity{ e2.id, m }).GetComponent("xyz!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xyz := c.data.(*Xyz); xyz.X != 4 || xyz.Y != 6 {
+		t.Error("Wrong data for moved component", xyz)
+	}
+}
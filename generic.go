@@ -0,0 +1,122 @@
+package spellbook
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Register registers T as a component type, as RegisterComponent does. The
+// generic functions find components by their type, so each type should only
+// be registered under one name to be used with them.
+func Register[T any](m *Manager, name string, table string, deps []string, opts ...RegisterOption) error {
+	var zero T
+	return m.RegisterComponent(name, table, zero, deps, opts...)
+}
+
+// RegisterLocal registers T as a local component type, as
+// RegisterLocalComponent does.
+func RegisterLocal[T any](m *Manager, name string, deps []string) error {
+	var zero T
+	return m.RegisterLocalComponent(name, zero, deps)
+}
+
+// nameOf finds the name T is registered under.
+func nameOf[T any](m *Manager) (string, error) {
+	typ := reflect.TypeOf((*T)(nil)).Elem()
+	found := ""
+	for name, ctype := range m.componentTypes {
+		if ctype.typ != typ {
+			continue
+		}
+		if found != "" {
+			return "", fmt.Errorf("Type %s is registered as both %s and %s", typ, found, name)
+		}
+		found = name
+	}
+	if found == "" {
+		return "", ErrComponentNotRegistered
+	}
+	return found, nil
+}
+
+// Get loads the entity's component of type T.
+func Get[T any](e *Entity) (*T, error) {
+	name, err := nameOf[T](e.manager)
+	if err != nil {
+		return nil, err
+	}
+	c, err := e.GetComponent(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.data.(*T), nil
+}
+
+// Add gives the entity a new component of type T with the value v.
+func Add[T any](e *Entity, v T) error {
+	name, err := nameOf[T](e.manager)
+	if err != nil {
+		return err
+	}
+	c, err := e.NewComponent(name)
+	if err != nil {
+		return err
+	}
+	*c.data.(*T) = v
+	return c.Save()
+}
+
+// Set saves v as the entity's component of type T, whether or not it had
+// one before.
+func Set[T any](e *Entity, v T) error {
+	name, err := nameOf[T](e.manager)
+	if err != nil {
+		return err
+	}
+	c, err := e.GetComponent(name)
+	if err == ErrNoComponent {
+		c, err = e.NewComponent(name)
+	}
+	if err != nil {
+		return err
+	}
+	*c.data.(*T) = v
+	return c.Save()
+}
+
+// A TypedQuery is a Query over the components of type T. Its Run returns an
+// iterator over typed values; use the embedded Query with Eq and the like.
+type TypedQuery[T any] struct {
+	Query
+}
+
+// QueryOf starts a query over all components of type T.
+func QueryOf[T any](m *Manager) *TypedQuery[T] {
+	name, err := nameOf[T](m)
+	if err != nil {
+		return &TypedQuery[T]{ &dbQuery{ err: err } }
+	}
+	return &TypedQuery[T]{ m.QueryComponent(name) }
+}
+
+func (q *TypedQuery[T]) Run() (*TypedComponents[T], error) {
+	cs, err := q.Query.Run()
+	if err != nil {
+		return nil, err
+	}
+	return &TypedComponents[T]{ cs }, nil
+}
+
+// TypedComponents iterates over components of type T.
+type TypedComponents[T any] struct {
+	Components
+}
+
+// Value is the current component's value, or nil if there is none.
+func (cs *TypedComponents[T]) Value() *T {
+	c := cs.Component()
+	if c == nil {
+		return nil
+	}
+	return c.data.(*T)
+}
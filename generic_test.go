@@ -0,0 +1,89 @@
+package spellbook
+
+import (
+	"testing"
+)
+
+func TestGenericComponents(t *testing.T) {
+	forEachBackend(t, func(m *Manager) {
+		if err := Register[Xyz](m, "xyz!", "xyz", nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := RegisterLocal[Nd](m, "nd!", nil); err != nil {
+			t.Fatal(err)
+		}
+		e, _ := m.NewEntity()
+		if err := Add(e, Xyz{ 1, 2, 3 }); err != nil {
+			t.Fatal(err)
+		}
+		if err := Add(e, Xyz{ 4, 5, 6 }); err != ErrDuplicateComponent {
+			t.Error("Added a second xyz!:", err)
+		}
+		xyz, err := Get[Xyz](e)
+		if err != nil || *xyz != (Xyz{ 1, 2, 3 }) {
+			t.Error("Got", xyz, err)
+		}
+		if _, err := Get[Nd](e); err != ErrNoComponent {
+			t.Error("Got", err, "instead of ErrNoComponent")
+		}
+		if _, err := Get[So](e); err != ErrComponentNotRegistered {
+			t.Error("Got", err, "instead of ErrComponentNotRegistered")
+		}
+		if err := Set(e, Nd{ "hi" }); err != nil {
+			t.Fatal(err)
+		}
+		if err := Set(e, Xyz{ 7, 8, 9 }); err != nil {
+			t.Fatal(err)
+		}
+		if nd, err := Get[Nd](e); err != nil || nd.N != "hi" {
+			t.Error("Got", nd, err)
+		}
+		if xyz, err := Get[Xyz](e); err != nil || xyz.X != 7 {
+			t.Error("Got", xyz, err)
+		}
+	})
+}
+
+func TestGenericQuery(t *testing.T) {
+	forEachBackend(t, func(m *Manager) {
+		Register[Xyz](m, "xyz!", "xyz", nil)
+		for x := 1; x <= 4; x++ {
+			e, _ := m.NewEntity()
+			Add(e, Xyz{ X: x })
+		}
+		q := QueryOf[Xyz](m)
+		if err := Gt(q.Query, "X", 2); err != nil {
+			t.Fatal(err)
+		}
+		q.OrderBy("X", Desc)
+		cs, err := q.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := cs.Value(); v != nil {
+			t.Error("Got", v, "before calling Next")
+		}
+		xs := []int{}
+		for cs.Next() {
+			xs = append(xs, cs.Value().X)
+		}
+		cs.Close()
+		if len(xs) != 2 || xs[0] != 4 || xs[1] != 3 {
+			t.Error("Got", xs)
+		}
+
+		if _, err := QueryOf[So](m).Run(); err != ErrComponentNotRegistered {
+			t.Error("Got", err, "instead of ErrComponentNotRegistered")
+		}
+	})
+}
+
+func TestGenericAmbiguousType(t *testing.T) {
+	m, _ := NewManagerWithBackend(NewLocalBackend())
+	RegisterLocal[Xyz](m, "a", nil)
+	RegisterLocal[Xyz](m, "b", nil)
+	e, _ := m.NewEntity()
+	if err := Add(e, Xyz{}); err == nil {
+		t.Error("Added a component of a type registered twice")
+	}
+}
@@ -0,0 +1,331 @@
+package spellbook
+
+import (
+	"errors"
+	"reflect"
+)
+
+// localBackend keeps entities and components in memory. Like other backends
+// it stores and hands out copies of components, so they only change when
+// saved.
+type localBackend struct {
+	nextID int64
+	entities map[int64]bool
+	components map[string]map[int64]interface{}
+}
+
+// NewLocalBackend creates a Backend keeping everything in memory. It backs
+// local components, and can back a whole Manager which needn't outlive the
+// process.
+func NewLocalBackend() Backend {
+	return &localBackend{ entities: make(map[int64]bool), components: make(map[string]map[int64]interface{}) }
+}
+
+func (b *localBackend) NewEntity() (int64, error) {
+	b.nextID += 1
+	b.entities[b.nextID] = true
+	return b.nextID, nil
+}
+
+func (b *localBackend) DeleteEntity(id int64) error {
+	delete(b.entities, id)
+	return nil
+}
+
+func (b *localBackend) Entities() (IDs, error) {
+	ids := make([]int64, 0, len(b.entities))
+	for id, _ := range b.entities {
+		ids = append(ids, id)
+	}
+	return &sliceIDs{ ids, -1 }, nil
+}
+
+func (b *localBackend) HasEntity(id int64) (bool, error) {
+	return b.entities[id], nil
+}
+
+func (b *localBackend) Register(ctype *ComponentType) error {
+	b.components[ctype.name] = make(map[int64]interface{})
+	return nil
+}
+
+func (b *localBackend) Get(ctype *ComponentType, entity int64) (interface{}, error) {
+	data, ok := b.components[ctype.name][entity]
+	if !ok {
+		return nil, ErrNoComponent
+	}
+	return clone(data), nil
+}
+
+func (b *localBackend) Save(ctype *ComponentType, entity int64, data interface{}, isNew bool) error {
+	b.components[ctype.name][entity] = clone(data)
+	return nil
+}
+
+func (b *localBackend) Remove(ctype *ComponentType, entity int64) error {
+	components := b.components[ctype.name]
+	if _, ok := components[entity]; !ok {
+		return ErrNoComponent
+	}
+	delete(components, entity)
+	return nil
+}
+
+func (b *localBackend) Move(ctype *ComponentType, from, to int64, data interface{}) error {
+	components := b.components[ctype.name]
+	if _, ok := components[from]; !ok {
+		return ErrNoComponent
+	}
+	delete(components, from)
+	components[to] = clone(data)
+	return nil
+}
+
+func (b *localBackend) Query(m *Manager, ctype *ComponentType) Query {
+	return NewMemoryQuery(m, ctype, func() map[int64]interface{} {
+		return b.components[ctype.name]
+	})
+}
+
+func (b *localBackend) Begin() (BackendTx, error) {
+	return &localTx{ localBackend: b }, nil
+}
+
+// localTx makes changes straight away, remembering how to undo them should
+// the transaction be rolled back.
+type localTx struct {
+	*localBackend
+	undo []func()
+}
+
+func (tx *localTx) NewEntity() (int64, error) {
+	id, err := tx.localBackend.NewEntity()
+	tx.undo = append(tx.undo, func() { delete(tx.entities, id) })
+	return id, err
+}
+
+func (tx *localTx) DeleteEntity(id int64) error {
+	if tx.entities[id] {
+		tx.undo = append(tx.undo, func() { tx.entities[id] = true })
+	}
+	return tx.localBackend.DeleteEntity(id)
+}
+
+// restore undoes changes to an entity's component.
+func (tx *localTx) restore(ctype *ComponentType, entity int64) {
+	components := tx.components[ctype.name]
+	old, ok := components[entity]
+	tx.undo = append(tx.undo, func() {
+		if ok {
+			components[entity] = old
+		} else {
+			delete(components, entity)
+		}
+	})
+}
+
+func (tx *localTx) Save(ctype *ComponentType, entity int64, data interface{}, isNew bool) error {
+	tx.restore(ctype, entity)
+	return tx.localBackend.Save(ctype, entity, data, isNew)
+}
+
+func (tx *localTx) Remove(ctype *ComponentType, entity int64) error {
+	tx.restore(ctype, entity)
+	return tx.localBackend.Remove(ctype, entity)
+}
+
+func (tx *localTx) Move(ctype *ComponentType, from, to int64, data interface{}) error {
+	tx.restore(ctype, from)
+	tx.restore(ctype, to)
+	return tx.localBackend.Move(ctype, from, to, data)
+}
+
+func (tx *localTx) Commit() error {
+	tx.undo = nil
+	return nil
+}
+
+func (tx *localTx) Rollback() error {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+	tx.undo = nil
+	return nil
+}
+
+type sliceComponents struct {
+	slice []*Component
+	index int
+	closed bool
+	err error
+	ctype *ComponentType
+	paging *paging
+}
+
+func (cs *sliceComponents) Close() error {
+	cs.closed = true
+	cs.slice = nil
+	return cs.err
+}
+
+func (cs *sliceComponents) Component() *Component {
+	if cs.closed {
+		cs.err = errors.New("Iterator already closed")
+		return nil
+	}
+	if cs.index < 0 {
+		cs.err = errors.New("Next() not called on iterator")
+		return nil
+	}
+	return cs.slice[cs.index]
+}
+
+func (cs *sliceComponents) Next() bool {
+	if cs.closed {
+		cs.err = errors.New("Iterator already closed")
+		return false
+	}
+	cs.index += 1
+	return cs.index < len(cs.slice)
+}
+
+func (cs *sliceComponents) Cursor() string {
+	i := cs.index
+	if i >= len(cs.slice) {
+		i = len(cs.slice) - 1
+	}
+	if i < 0 {
+		return cs.paging.cursor(cs.ctype, nil)
+	}
+	return cs.paging.cursor(cs.ctype, cs.slice[i])
+}
+
+func (cs *sliceComponents) Err() error {
+	return cs.err
+}
+
+// NewMemoryQuery makes a Query over components held in memory, keyed by
+// entity, which it filters, orders and pages like the local backend does. A
+// Backend can return one from Query rather than implement querying itself.
+// The query calls components each time it runs, so that it sees what was
+// saved up to then; the map it returns must not change while the query
+// runs. The components are copied as they are returned.
+func NewMemoryQuery(m *Manager, ctype *ComponentType, components func() map[int64]interface{}) Query {
+	return &localQuery{ ctype: ctype, manager: m, data: components, filters: make([]Expr, 0) }
+}
+
+type localQuery struct {
+	ctype *ComponentType
+	manager *Manager
+	data func() map[int64]interface{}
+	filters []Expr
+	paging
+	err error
+}
+
+func (q *localQuery) Run() (Components, error) {
+	cs, err := q.components()
+	if err != nil {
+		return nil, err
+	}
+	return &sliceComponents{ slice: cs, index: -1, ctype: q.ctype, paging: &q.paging }, nil
+}
+
+// components finds the query's components, in order.
+func (q *localQuery) components() ([]*Component, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+	cs := make([]*Component, 0)
+	filter := And(q.filters...)
+	after, err := q.afterCursor(q.ctype)
+	if err != nil {
+		return nil, err
+	}
+	if after != nil {
+		filter = And(filter, *after)
+	}
+	for id, data := range q.candidates() {
+		if filter.match(q.ctype, id, reflect.ValueOf(data).Elem()) {
+			c, err := q.manager.Bind(q.ctype, id, clone(data))
+			if err != nil {
+				return nil, err
+			}
+			cs = append(cs, c)
+		}
+	}
+	return q.page(q.ctype, cs)
+}
+
+// candidates are the components which may match the query: those of the
+// entities picked by an EntityIn filter, looked up directly, or else all of
+// them.
+func (q *localQuery) candidates() map[int64]interface{} {
+	all := q.data()
+	for _, e := range q.filters {
+		if ids, ok := e.value.([]int64); ok && e.entity && e.op == "in" {
+			data := make(map[int64]interface{})
+			for _, id := range ids {
+				if c, ok := all[id]; ok {
+					data[id] = c
+				}
+			}
+			return data
+		}
+	}
+	return all
+}
+
+func (q *localQuery) Count() (int64, error) {
+	cs, err := q.components()
+	return int64(len(cs)), err
+}
+
+func (q *localQuery) Exists() (bool, error) {
+	cs, err := q.components()
+	return len(cs) > 0, err
+}
+
+func (q *localQuery) Sum(field string) (float64, error) {
+	return q.aggregate("sum", field)
+}
+
+func (q *localQuery) Min(field string) (float64, error) {
+	return q.aggregate("min", field)
+}
+
+func (q *localQuery) Max(field string) (float64, error) {
+	return q.aggregate("max", field)
+}
+
+func (q *localQuery) Avg(field string) (float64, error) {
+	return q.aggregate("avg", field)
+}
+
+func (q *localQuery) aggregate(fn string, field string) (float64, error) {
+	f, err := numericField(q.ctype, field)
+	if err != nil {
+		return 0, err
+	}
+	cs, err := q.components()
+	if err != nil {
+		return 0, err
+	}
+	return aggregate(fn, f, cs)
+}
+
+func (q *localQuery) Where(field string, other interface{}, op string) error {
+	return q.Filter(Compare(field, op, other))
+}
+
+func (q *localQuery) Filter(e Expr) error {
+	if q.err != nil {
+		return q.err
+	}
+	if err := e.check(q.ctype); err != nil {
+		q.err = err
+		return err
+	}
+	q.filters = append(q.filters, e)
+	return nil
+}
@@ -0,0 +1,182 @@
+package spellbook
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var ErrDuplicateMigration = errors.New("Component already has a migration with that version")
+
+// A Migration changes a component's table from the previous version to
+// Version. Versions start at 1 and needn't be consecutive; pending migrations
+// are applied in order of version when the component is registered.
+type Migration struct {
+	Version int
+	Description string
+	Up func(tx *sql.Tx) error
+}
+
+// AddMigration registers a migration for the named component. Migrations must
+// be added before the component itself is registered.
+func (m *Manager) AddMigration(component string, mig Migration) error {
+	if mig.Version < 1 {
+		return fmt.Errorf("Invalid migration version %d", mig.Version)
+	}
+	if mig.Up == nil {
+		return errors.New("Migration has no Up function")
+	}
+	migs := m.migrations[component]
+	for _, other := range migs {
+		if other.Version == mig.Version {
+			return ErrDuplicateMigration
+		}
+	}
+	migs = append(migs, mig)
+	sort.Slice(migs, func(i, j int) bool { return migs[i].Version < migs[j].Version })
+	m.migrations[component] = migs
+	return nil
+}
+
+// AutoMigrate makes RegisterComponent add columns for struct fields missing
+// from the component's table. New columns are not null, with the zero value
+// of the field's type as their default.
+func AutoMigrate() RegisterOption {
+	return func(r *registration) {
+		r.autoMigrate = true
+	}
+}
+
+func (b *sqlBackend) recordMigration(tx *sql.Tx, component string, mig Migration) error {
+	_, err := tx.Exec(rebind(b.dialect, "insert into spellbook_migrations (component, version, description) values (?, ?, ?)"), component, mig.Version, mig.Description)
+	return err
+}
+
+func (b *sqlBackend) appliedMigrations(component string) (map[int]bool, error) {
+	rs, err := b.query("select version from spellbook_migrations where component = ?", component)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	applied := make(map[int]bool)
+	for rs.Next() {
+		var v int
+		if err := rs.Scan(&v); err != nil {
+			return nil, err
+		}
+		applied[v] = true
+	}
+	return applied, rs.Err()
+}
+
+// applyMigrations runs the component's pending migrations, each in its own
+// transaction along with the record of it being applied.
+func (b *sqlBackend) applyMigrations(ctype *ComponentType) error {
+	component := ctype.name
+	applied, err := b.appliedMigrations(component)
+	if err != nil {
+		return err
+	}
+	for _, mig := range ctype.migrations {
+		if applied[mig.Version] {
+			continue
+		}
+		tx, err := b.db.Begin()
+		if err != nil {
+			return err
+		}
+		err = mig.Up(tx)
+		if err == nil {
+			err = b.recordMigration(tx, component, mig)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Migration %d of %s failed: %s", mig.Version, component, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zeroDefault is a SQL literal for the zero value of fields of type t.
+func zeroDefault(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "false"
+	case reflect.String, reflect.Slice:
+		return "''"
+	}
+	return "0"
+}
+
+// addMissingColumns adds a column for each stored field of the component
+// which its table lacks.
+func (b *sqlBackend) addMissingColumns(ctype *ComponentType, cols []column) error {
+	have := make(map[string]bool)
+	for _, c := range cols {
+		have[strings.ToLower(c.name)] = true
+	}
+	for _, f := range ctype.fields {
+		if have[strings.ToLower(f.column)] {
+			continue
+		}
+		t := ctype.typ.Field(f.index).Type
+		ct, err := b.dialect.ColumnType(t)
+		if err != nil {
+			return fmt.Errorf("Field %s: %s", f.name, err)
+		}
+		if t.Kind() != reflect.Ptr {
+			ct += " not null default " + zeroDefault(t)
+		}
+		_, err = b.exec("alter table " + b.quote(ctype.table) + " add column " + b.quote(f.column) + " " + ct)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrate brings the component's table up to date with its struct type. A
+// table created from scratch by AutoCreate already has the shape every
+// registered migration leads to, so they're only recorded as applied.
+func (b *sqlBackend) migrate(ctype *ComponentType) error {
+	cols, err := b.tableColumns(ctype.table)
+	if err != nil {
+		return err
+	}
+	if len(cols) == 0 && ctype.registration.autoCreate {
+		tx, err := b.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err := b.createTable(tx, ctype); err != nil {
+			return err
+		}
+		for _, mig := range ctype.migrations {
+			if err := b.recordMigration(tx, ctype.name, mig); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}
+	if err := b.applyMigrations(ctype); err != nil {
+		return err
+	}
+	if !ctype.registration.autoMigrate {
+		return nil
+	}
+	cols, err = b.tableColumns(ctype.table)
+	if err != nil {
+		return err
+	}
+	if len(cols) == 0 {
+		return nil
+	}
+	return b.addMissingColumns(ctype, cols)
+}
@@ -0,0 +1,100 @@
+package spellbook
+
+import (
+	"database/sql"
+	"testing"
+)
+
+type Xyzw struct {
+	X int
+	Y int
+	Z int
+	W float64
+	Label string
+}
+
+func TestAutoMigratingComponent(t *testing.T) {
+	m := getEmptyManager()
+
+	err := m.RegisterComponent("xyzw", "xyz", Xyzw{}, nil)
+	if _, ok := err.(*SchemaError); !ok {
+		t.Fatal("Registered an evolved component without migrating:", err)
+	}
+	err = m.RegisterComponent("xyzw", "xyz", Xyzw{}, nil, AutoMigrate())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, _ := m.NewEntity()
+	c, _ := e.NewComponent("xyzw")
+	c.data.(*Xyzw).W = 2.5
+	c.data.(*Xyzw).Label = "w"
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	c, err = e.GetComponent("xyzw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := c.data.(*Xyzw); w.W != 2.5 || w.Label != "w" {
+		t.Error("Retrieved wrong data", w)
+	}
+}
+
+func TestVersionedMigrations(t *testing.T) {
+	db := getEmptyDB()
+	runs := 0
+	addColumn := Migration{
+		Version: 1,
+		Description: "add M",
+		Up: func(tx *sql.Tx) error {
+			runs++
+			_, err := tx.Exec("alter table nd add column M integer not null default 7")
+			return err
+		},
+	}
+	type ndm struct {
+		N string
+		M int
+	}
+
+	for i := 0; i < 2; i++ {
+		m, err := NewManager(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.AddMigration("N?", addColumn); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.AddMigration("N?", addColumn); err != ErrDuplicateMigration {
+			t.Error("Added a migration with a duplicate version:", err)
+		}
+		if err := m.RegisterComponent("N?", "nd", ndm{}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if runs != 1 {
+		t.Error("Migration ran", runs, "times instead of once")
+	}
+}
+
+func TestAutoCreateSkipsMigrations(t *testing.T) {
+	db := getEmptyDB()
+	m, _ := NewManager(db)
+	m.AddMigration("stats", Migration{
+		Version: 3,
+		Up: func(tx *sql.Tx) error {
+			t.Error("Ran a migration on a freshly created table")
+			return nil
+		},
+	})
+	if err := m.RegisterComponent("stats", "stats", Stats{}, nil, AutoCreate()); err != nil {
+		t.Fatal(err)
+	}
+
+	var version int
+	db.QueryRow("select version from spellbook_migrations where component = 'stats'").Scan(&version)
+	if version != 3 {
+		t.Error("Migration not recorded as applied for a created table")
+	}
+}
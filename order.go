@@ -0,0 +1,124 @@
+package spellbook
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// An Order is the direction in which Query.OrderBy sorts.
+type Order int
+
+const (
+	Asc Order = iota
+	Desc
+)
+
+type ordering struct {
+	field string
+	order Order
+}
+
+// paging holds what a query sorts by and which of the sorted components it
+// returns. It is shared by the queries of every backend.
+type paging struct {
+	orders []ordering
+	limit int
+	hasLimit bool
+	offset int
+	after string
+	pagingErr error
+}
+
+func (p *paging) OrderBy(field string, order Order) {
+	p.orders = append(p.orders, ordering{ field, order })
+}
+
+func (p *paging) Limit(n int) {
+	if n < 0 {
+		p.pagingErr = errors.New("Negative limit")
+		return
+	}
+	p.limit = n
+	p.hasLimit = true
+}
+
+func (p *paging) Offset(n int) {
+	if n < 0 {
+		p.pagingErr = errors.New("Negative offset")
+		return
+	}
+	p.offset = n
+}
+
+// paged reports whether the query has to be ordered. A query given a bad
+// limit or offset counts as paged, so that the error is reported when the
+// order is worked out.
+func (p *paging) paged() bool {
+	return len(p.orders) > 0 || p.hasLimit || p.offset > 0 || p.after != "" || p.pagingErr != nil
+}
+
+// orderFields looks up the fields ordered by.
+func (p *paging) orderFields(ctype *ComponentType) ([]field, error) {
+	if p.pagingErr != nil {
+		return nil, p.pagingErr
+	}
+	fields := make([]field, len(p.orders))
+	for i, o := range p.orders {
+		f, ok := ctype.field(o.field)
+		if !ok {
+			return nil, fmt.Errorf("Can't order by %s: no such field in %s", o.field, ctype.name)
+		}
+		fields[i] = f
+	}
+	return fields, nil
+}
+
+// page sorts components found in memory and picks out those asked for.
+func (p *paging) page(ctype *ComponentType, cs []*Component) ([]*Component, error) {
+	fields, err := p.orderFields(ctype)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(cs, func(i, j int) bool {
+		a := reflect.ValueOf(cs[i].data).Elem()
+		b := reflect.ValueOf(cs[j].data).Elem()
+		for k, f := range fields {
+			c := compareFields(a.Field(f.index), b.Field(f.index))
+			if p.orders[k].order == Desc {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return cs[i].entity < cs[j].entity
+	})
+	if p.offset >= len(cs) {
+		return cs[:0], nil
+	}
+	cs = cs[p.offset:]
+	if p.hasLimit && p.limit < len(cs) {
+		cs = cs[:p.limit]
+	}
+	return cs, nil
+}
+
+// compareFields orders the values of two fields of the same type, with nil
+// pointers first.
+func compareFields(a reflect.Value, b reflect.Value) int {
+	if a.Kind() == reflect.Ptr {
+		switch {
+		case a.IsNil() && b.IsNil():
+			return 0
+		case a.IsNil():
+			return -1
+		case b.IsNil():
+			return 1
+		}
+		a, b = a.Elem(), b.Elem()
+	}
+	c, _ := compareValues(a, b)
+	return c
+}
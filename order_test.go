@@ -0,0 +1,114 @@
+package spellbook
+
+import (
+	"testing"
+)
+
+func TestOrderingAndPaging(t *testing.T) {
+	forEachBackend(t, func(m *Manager) {
+		m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
+		for x := 0; x < 6; x++ {
+			e, _ := m.NewEntity()
+			c, _ := e.NewComponent("xyz!")
+			c.data.(*Xyz).X = x
+			c.data.(*Xyz).Y = x % 2
+			c.Save()
+		}
+
+		q := m.QueryComponent("xyz!")
+		q.OrderBy("Y", Desc)
+		q.OrderBy("X", Asc)
+		q.Offset(1)
+		q.Limit(3)
+		cs, err := q.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		xs := make([]int, 0)
+		for cs.Next() {
+			xs = append(xs, cs.Component().data.(*Xyz).X)
+		}
+		cs.Close()
+		if len(xs) != 3 || xs[0] != 3 || xs[1] != 5 || xs[2] != 0 {
+			t.Error("Got", xs, "instead of [3 5 0]")
+		}
+
+		// without anything to order by, components come in entity order
+		q = m.QueryComponent("xyz!")
+		q.Offset(4)
+		cs, _ = q.Run()
+		xs = xs[:0]
+		for cs.Next() {
+			xs = append(xs, cs.Component().data.(*Xyz).X)
+		}
+		cs.Close()
+		if len(xs) != 2 || xs[0] != 4 || xs[1] != 5 {
+			t.Error("Got", xs, "instead of [4 5]")
+		}
+
+		q = m.QueryComponent("xyz!")
+		q.OrderBy("W", Asc)
+		if _, err := q.Run(); err == nil {
+			t.Error("Ordered by missing field")
+		}
+	})
+}
+
+func TestNegativeLimitAndOffset(t *testing.T) {
+	forEachBackend(t, func(m *Manager) {
+		m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
+		e, _ := m.NewEntity()
+		c, _ := e.NewComponent("xyz!")
+		c.Save()
+
+		for _, page := range []func(q Query){ func(q Query) { q.Limit(-1) }, func(q Query) { q.Offset(-1) } } {
+			q := m.QueryComponent("xyz!")
+			page(q)
+			if _, err := q.Run(); err == nil {
+				t.Error("Ran a query with a negative limit or offset")
+			}
+			if n, err := q.Count(); err == nil {
+				t.Error("Counted", n, "with a negative limit or offset")
+			}
+
+			eq := m.QueryEntities()
+			page(eq.With("xyz!"))
+			if _, err := eq.Run(); err == nil {
+				t.Error("Ran an entity query with a negative limit or offset")
+			}
+		}
+	})
+}
+
+func TestOrderingNulls(t *testing.T) {
+	for _, order := range []Order{ Asc, Desc } {
+		forEachBackend(t, func(m *Manager) {
+			names := namesOrdered(t, m, order)
+			if order == Desc {
+				for i, j := 0, len(names) - 1; i < j; i, j = i + 1, j - 1 {
+					names[i], names[j] = names[j], names[i]
+				}
+			}
+			if len(names) != 5 || names[0] != "Bob" || names[1] != "Alice" || names[4] != "Dave" {
+				t.Error("Got", names, "in order", order)
+			}
+		})
+	}
+}
+
+// namesOrdered lists the Nameds made by namesMatching by score.
+func namesOrdered(t *testing.T, m *Manager, order Order) []string {
+	namesMatching(t, m, func(q Query) {})
+	q := m.QueryComponent("named")
+	q.OrderBy("Score", order)
+	cs, err := q.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	names := make([]string, 0)
+	for cs.Next() {
+		names = append(names, cs.Component().data.(*Named).Name)
+	}
+	return names
+}
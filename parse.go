@@ -0,0 +1,384 @@
+package spellbook
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A SyntaxError is a mistake in a textual query, found at byte offset Pos.
+type SyntaxError struct {
+	Pos int
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("Syntax error at offset %d: %s", e.Pos, e.Msg)
+}
+
+// ParseQuery compiles a textual query into an EntityQuery. A query names a
+// component, then after a colon gives an optional condition on its fields,
+// followed by any number of with and without clauses naming other
+// components the entities must have or lack:
+//
+//	Xyz!: X > 3 and (Y < 2 or Z = 0) without Dead
+//
+// The condition is written as for ParseExpr. Component names which contain
+// spaces, colons or parentheses can be quoted.
+func (m *Manager) ParseQuery(text string) (*EntityQuery, error) {
+	p := &parser{ text: text }
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	eq := m.QueryEntities()
+	q := eq.With(name)
+	if !p.done() && !p.peekKeyword("with") && !p.peekKeyword("without") {
+		e, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := q.Filter(e); err != nil {
+			return nil, err
+		}
+	}
+	for !p.done() {
+		switch {
+		case p.keyword("with"):
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			eq.With(name)
+		case p.keyword("without"):
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			eq.Without(name)
+		default:
+			return nil, p.fail(p.pos, "expected with, without or the end of the query")
+		}
+	}
+	if eq.err != nil {
+		return nil, eq.err
+	}
+	return eq, nil
+}
+
+// ParseExpr compiles a textual condition on a component's fields, such as
+//
+//	X > 3 and (Y < 2 or not Z = 0)
+//
+// Fields are compared with =, !=, <>, <, >, <= and >=, or tested with
+// in (1, 2, 3), between 1 and 3, like 'pattern%', is null and is not null;
+// not in, not between and not like work too. Conditions are combined with
+// and, or, not and parentheses. Values are numbers, true, false, or strings
+// in single or double quotes, which are escaped by doubling them. Keywords
+// are case-insensitive.
+func ParseExpr(text string) (Expr, error) {
+	p := &parser{ text: text }
+	e, err := p.expr()
+	if err != nil {
+		return Expr{}, err
+	}
+	if !p.done() {
+		return Expr{}, p.fail(p.pos, "expected and, or or the end of the condition")
+	}
+	return e, nil
+}
+
+type parser struct {
+	text string
+	pos int
+}
+
+func (p *parser) fail(pos int, format string, args ...interface{}) error {
+	return &SyntaxError{ pos, fmt.Sprintf(format, args...) }
+}
+
+func (p *parser) skipSpace() {
+	for p.pos < len(p.text) {
+		r, n := utf8.DecodeRuneInString(p.text[p.pos:])
+		if !unicode.IsSpace(r) {
+			return
+		}
+		p.pos += n
+	}
+}
+
+func (p *parser) done() bool {
+	p.skipSpace()
+	return p.pos == len(p.text)
+}
+
+// word is the identifier starting at the current position, if any.
+func (p *parser) word() string {
+	p.skipSpace()
+	end := p.pos
+	for end < len(p.text) {
+		r, n := utf8.DecodeRuneInString(p.text[end:])
+		if !(r == '_' || unicode.IsLetter(r) || (end > p.pos && unicode.IsDigit(r))) {
+			break
+		}
+		end += n
+	}
+	return p.text[p.pos:end]
+}
+
+func (p *parser) peekKeyword(kw string) bool {
+	return strings.EqualFold(p.word(), kw)
+}
+
+// keyword skips over kw if it comes next.
+func (p *parser) keyword(kw string) bool {
+	w := p.word()
+	if !strings.EqualFold(w, kw) {
+		return false
+	}
+	p.pos += len(w)
+	return true
+}
+
+func (p *parser) expect(s string) error {
+	p.skipSpace()
+	if !strings.HasPrefix(p.text[p.pos:], s) {
+		return p.fail(p.pos, "expected %q", s)
+	}
+	p.pos += len(s)
+	return nil
+}
+
+// name reads a component name, which runs up to a space, colon or
+// parenthesis unless it is quoted.
+func (p *parser) name() (string, error) {
+	p.skipSpace()
+	start := p.pos
+	if p.pos < len(p.text) && (p.text[p.pos] == '"' || p.text[p.pos] == '\'') {
+		return p.quoted()
+	}
+	for p.pos < len(p.text) {
+		r, n := utf8.DecodeRuneInString(p.text[p.pos:])
+		if unicode.IsSpace(r) || strings.ContainsRune(":(),", r) {
+			break
+		}
+		p.pos += n
+	}
+	if p.pos == start {
+		return "", p.fail(start, "expected a component name")
+	}
+	return p.text[start:p.pos], nil
+}
+
+func (p *parser) quoted() (string, error) {
+	start := p.pos
+	quote := p.text[p.pos]
+	var s strings.Builder
+	for p.pos++; p.pos < len(p.text); p.pos++ {
+		if p.text[p.pos] == quote {
+			if p.pos + 1 < len(p.text) && p.text[p.pos + 1] == quote {
+				p.pos++
+			} else {
+				p.pos++
+				return s.String(), nil
+			}
+		}
+		s.WriteByte(p.text[p.pos])
+	}
+	return "", p.fail(start, "unterminated string")
+}
+
+func (p *parser) expr() (Expr, error) {
+	e, err := p.and()
+	if err != nil {
+		return Expr{}, err
+	}
+	operands := []Expr{ e }
+	for p.keyword("or") {
+		e, err := p.and()
+		if err != nil {
+			return Expr{}, err
+		}
+		operands = append(operands, e)
+	}
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return Or(operands...), nil
+}
+
+func (p *parser) and() (Expr, error) {
+	e, err := p.not()
+	if err != nil {
+		return Expr{}, err
+	}
+	operands := []Expr{ e }
+	for p.keyword("and") {
+		e, err := p.not()
+		if err != nil {
+			return Expr{}, err
+		}
+		operands = append(operands, e)
+	}
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return And(operands...), nil
+}
+
+func (p *parser) not() (Expr, error) {
+	if p.keyword("not") {
+		e, err := p.not()
+		if err != nil {
+			return Expr{}, err
+		}
+		return Not(e), nil
+	}
+	p.skipSpace()
+	if strings.HasPrefix(p.text[p.pos:], "(") {
+		p.pos++
+		e, err := p.expr()
+		if err != nil {
+			return Expr{}, err
+		}
+		if err := p.expect(")"); err != nil {
+			return Expr{}, err
+		}
+		return e, nil
+	}
+	return p.comparison()
+}
+
+var comparisonOps = []string{ "<=", ">=", "!=", "<>", "=", "<", ">" }
+
+func (p *parser) comparison() (Expr, error) {
+	start := p.pos
+	field := p.word()
+	if field == "" {
+		return Expr{}, p.fail(start, "expected a field name")
+	}
+	p.pos += len(field)
+	p.skipSpace()
+	for _, op := range comparisonOps {
+		if strings.HasPrefix(p.text[p.pos:], op) {
+			p.pos += len(op)
+			if op == "<>" {
+				op = "!="
+			}
+			v, err := p.value()
+			if err != nil {
+				return Expr{}, err
+			}
+			return Compare(field, op, v), nil
+		}
+	}
+	if p.keyword("is") {
+		op := "is null"
+		if p.keyword("not") {
+			op = "is not null"
+		}
+		if !p.keyword("null") {
+			return Expr{}, p.fail(p.pos, "expected null")
+		}
+		return Compare(field, op, nil), nil
+	}
+	negated := p.keyword("not")
+	var e Expr
+	switch {
+	case p.keyword("in"):
+		if err := p.expect("("); err != nil {
+			return Expr{}, err
+		}
+		vals := make([]interface{}, 0)
+		p.skipSpace()
+		if !strings.HasPrefix(p.text[p.pos:], ")") {
+			for {
+				v, err := p.value()
+				if err != nil {
+					return Expr{}, err
+				}
+				vals = append(vals, v)
+				p.skipSpace()
+				if !strings.HasPrefix(p.text[p.pos:], ",") {
+					break
+				}
+				p.pos++
+			}
+		}
+		if err := p.expect(")"); err != nil {
+			return Expr{}, err
+		}
+		e = Compare(field, "in", vals)
+	case p.keyword("between"):
+		lo, err := p.value()
+		if err != nil {
+			return Expr{}, err
+		}
+		if !p.keyword("and") {
+			return Expr{}, p.fail(p.pos, "expected and")
+		}
+		hi, err := p.value()
+		if err != nil {
+			return Expr{}, err
+		}
+		e = Compare(field, "between", []interface{}{ lo, hi })
+	case p.keyword("like"):
+		p.skipSpace()
+		at := p.pos
+		v, err := p.value()
+		if err != nil {
+			return Expr{}, err
+		}
+		if _, ok := v.(string); !ok {
+			return Expr{}, p.fail(at, "expected a string")
+		}
+		e = Compare(field, "like", v)
+	default:
+		return Expr{}, p.fail(p.pos, "expected an operator after %s", field)
+	}
+	if negated {
+		return Not(e), nil
+	}
+	return e, nil
+}
+
+// value reads a number, string, true or false.
+func (p *parser) value() (interface{}, error) {
+	p.skipSpace()
+	start := p.pos
+	if p.pos == len(p.text) {
+		return nil, p.fail(start, "expected a value")
+	}
+	switch c := p.text[p.pos]; {
+	case c == '\'' || c == '"':
+		return p.quoted()
+	case c == '-' || c == '+' || c == '.' || (c >= '0' && c <= '9'):
+		end := p.pos + 1
+		for end < len(p.text) && strings.IndexByte("0123456789.eE", p.text[end]) >= 0 ||
+			end < len(p.text) && (p.text[end] == '-' || p.text[end] == '+') && (p.text[end - 1] == 'e' || p.text[end - 1] == 'E') {
+			end++
+		}
+		num := p.text[start:end]
+		p.pos = end
+		if i, err := strconv.ParseInt(num, 10, 64); err == nil {
+			return i, nil
+		}
+		f, err := strconv.ParseFloat(num, 64)
+		if err != nil {
+			return nil, p.fail(start, "malformed number %s", num)
+		}
+		return f, nil
+	}
+	switch {
+	case p.keyword("true"):
+		return true, nil
+	case p.keyword("false"):
+		return false, nil
+	}
+	return nil, p.fail(start, "expected a value")
+}
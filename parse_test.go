@@ -0,0 +1,106 @@
+package spellbook
+
+import (
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	forEachBackend(t, func(m *Manager) {
+		m.RegisterComponent("Xyz!", "xyz", Xyz{}, nil)
+		m.RegisterComponent("N?", "nd", Nd{}, nil)
+		for x := 0; x < 8; x++ {
+			e, _ := m.NewEntity()
+			c, _ := e.NewComponent("Xyz!")
+			c.data.(*Xyz).X = x
+			c.data.(*Xyz).Y = x % 4
+			c.data.(*Xyz).Z = x % 3
+			c.Save()
+			if x == 6 {
+				c, _ = e.NewComponent("N?")
+				c.data.(*Nd).N = "dead"
+				c.Save()
+			}
+		}
+
+		queries := map[string][]int{
+			"Xyz!: X > 3 and (Y < 2 or Z = 0) without N?": { 4, 5 },
+			"Xyz!:": { 0, 1, 2, 3, 4, 5, 6, 7 },
+			"Xyz!: not X in (1, 2, 3) AND Y <> 0 without N?": { 5, 7 },
+			"Xyz!: X between 2 and 4 or X >= 7.5 with N?": {},
+			"Xyz!: X not between 1 and 6 with N?": {},
+			"'Xyz!': Z=2 and not (Y=1)": { 2 },
+			"Xyz! : X < -1 or X = +1": { 1 },
+		}
+		for text, expected := range queries {
+			eq, err := m.ParseQuery(text)
+			if err != nil {
+				t.Error(text, err)
+				continue
+			}
+			ts, err := eq.Run()
+			if err != nil {
+				t.Error(text, err)
+				continue
+			}
+			xs := make([]int, 0)
+			for ts.Next() {
+				xs = append(xs, ts.Component("Xyz!").data.(*Xyz).X)
+			}
+			ok := len(xs) == len(expected)
+			for i := 0; ok && i < len(xs); i++ {
+				ok = xs[i] == expected[i]
+			}
+			if !ok {
+				t.Error(text, "found", xs, "instead of", expected)
+			}
+		}
+
+		eq, err := m.ParseQuery(`N?: N like 'D%' and N is not null`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts, _ := eq.Run()
+		if !ts.Next() || ts.Component("N?").data.(*Nd).N != "dead" {
+			t.Error("Didn't find N? with like")
+		}
+
+		if _, err := m.ParseQuery("Xyz!: W = 1"); err == nil {
+			t.Error("Parsed query on missing field")
+		}
+		if _, err := m.ParseQuery("Nope: X = 1"); err != ErrComponentNotRegistered {
+			t.Error("Got", err, "parsing query on unregistered component")
+		}
+	})
+}
+
+func TestParseErrors(t *testing.T) {
+	errors := map[string]int{
+		"X >": 3,
+		"X > 1 and": 9,
+		"(X = 1": 6,
+		"X ~ 1": 2,
+		"X = 'open": 4,
+		"X in (1, 2": 10,
+		"X = 1 Y = 2": 6,
+		"X is nul": 5,
+		"X between 1 or 2": 12,
+	}
+	for text, pos := range errors {
+		_, err := ParseExpr(text)
+		se, ok := err.(*SyntaxError)
+		if !ok {
+			t.Error(text, "gave", err)
+			continue
+		}
+		if se.Pos != pos {
+			t.Error(text, "failed at", se.Pos, "instead of", pos, se)
+		}
+	}
+
+	m, _ := NewManagerWithBackend(NewLocalBackend())
+	if _, err := m.ParseQuery("Xyz! X = 1"); err == nil {
+		t.Error("Parsed query without colon")
+	} else if se, ok := err.(*SyntaxError); !ok || se.Pos != 5 {
+		t.Error("Got", err, "for query without colon")
+	}
+}
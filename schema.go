@@ -0,0 +1,349 @@
+package spellbook
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// A RegisterOption changes how RegisterComponent sets up a component.
+type RegisterOption func(*registration)
+
+type registration struct {
+	autoCreate bool
+	autoMigrate bool
+}
+
+// AutoCreate makes RegisterComponent create the component's table from the
+// component's struct type if the table doesn't exist yet. The table gets an
+// entity ID primary key referencing entities(id) and one column per stored
+// struct field, which is not null unless the field is a pointer.
+func AutoCreate() RegisterOption {
+	return func(r *registration) {
+		r.autoCreate = true
+	}
+}
+
+// columnType picks the SQL type used to store struct fields of type t.
+// Pointer fields are stored like what they point to, with nil as NULL.
+func columnType(t reflect.Type) (string, error) {
+	switch t.Kind() {
+	case reflect.Ptr:
+		if t.Elem().Kind() != reflect.Ptr {
+			return columnType(t.Elem())
+		}
+	case reflect.Bool:
+		return "boolean", nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer", nil
+	case reflect.Float32, reflect.Float64:
+		return "real", nil
+	case reflect.String:
+		return "text", nil
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "blob", nil
+		}
+	}
+	return "", fmt.Errorf("No column type for fields of type %s", t)
+}
+
+// A field is a struct field stored in a column of a component's table.
+type field struct {
+	name string
+	column string
+	index int
+}
+
+// A Field describes a stored field of a component's struct type to a Backend.
+type Field struct {
+	// Name is the field's Go name, as used in queries
+	Name string
+	// Column is where the field is stored, its name unless a tag says
+	// otherwise
+	Column string
+	// Index is the field's index in the struct, for reflect's Field
+	Index int
+}
+
+// structFields maps the fields of a component struct to columns. Fields are
+// stored in a column with the field's name unless tagged with another name,
+// as in `spellbook:"col_name"`. Fields tagged `spellbook:"-"` and unexported
+// fields aren't stored.
+func structFields(typ reflect.Type) ([]field, error) {
+	if typ.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("Component type %s is not a struct", typ)
+	}
+	fields := []field{}
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		column := f.Name
+		if tag, ok := f.Tag.Lookup("spellbook"); ok {
+			if tag == "-" {
+				continue
+			}
+			if name := strings.Split(tag, ",")[0]; name != "" {
+				column = name
+			}
+		}
+		fields = append(fields, field{ name: f.Name, column: column, index: i })
+	}
+	return fields, nil
+}
+
+// field looks up a stored field by its Go name.
+func (ctype *ComponentType) field(name string) (field, bool) {
+	for _, f := range ctype.fields {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return field{}, false
+}
+
+func (b *sqlBackend) createTableSQL(ctype *ComponentType) (string, error) {
+	idType, _ := b.dialect.ColumnType(reflect.TypeOf(int64(0)))
+	key := b.quote(b.entityColumn) + " " + idType + " not null primary key"
+	references := "references entities(id) on delete cascade"
+	foreignKey := ""
+	if d, ok := b.dialect.(*sqlDialect); ok && d.tableForeignKeys {
+		foreignKey = "foreign key (" + b.quote(b.entityColumn) + ") " + references
+	} else {
+		key += " " + references
+	}
+	columns := []string{ key }
+	for _, f := range ctype.fields {
+		ct, err := b.dialect.ColumnType(ctype.typ.Field(f.index).Type)
+		if err != nil {
+			return "", fmt.Errorf("Field %s: %s", f.name, err)
+		}
+		if ctype.typ.Field(f.index).Type.Kind() != reflect.Ptr {
+			ct += " not null"
+		}
+		columns = append(columns, b.quote(f.column) + " " + ct)
+	}
+	if foreignKey != "" {
+		columns = append(columns, foreignKey)
+	}
+	return "create table if not exists " + b.quote(ctype.table) + " (" + strings.Join(columns, ", ") + ")", nil
+}
+
+func (b *sqlBackend) createTable(tx *sql.Tx, ctype *ComponentType) error {
+	query, err := b.createTableSQL(ctype)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(query)
+	return err
+}
+
+// setField stores a value read from the database in a struct field, converting
+// between numeric types since drivers only hand back int64 and float64.
+func setField(f reflect.Value, v reflect.Value) error {
+	if !v.IsValid() {
+		f.Set(reflect.Zero(f.Type()))
+		return nil
+	}
+	switch f.Kind() {
+	case reflect.Ptr:
+		p := reflect.New(f.Type().Elem())
+		if err := setField(p.Elem(), v); err != nil {
+			return err
+		}
+		f.Set(p)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+			reflect.Float32, reflect.Float64:
+			f.Set(v.Convert(f.Type()))
+			return nil
+		}
+	case reflect.Bool:
+		switch v.Kind() {
+		case reflect.Bool:
+			f.SetBool(v.Bool())
+			return nil
+		case reflect.Int64:
+			f.SetBool(v.Int() != 0)
+			return nil
+		}
+	case reflect.String:
+		switch {
+		case v.Kind() == reflect.String:
+			f.SetString(v.String())
+			return nil
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			f.SetString(string(v.Bytes()))
+			return nil
+		}
+	}
+	if !v.Type().AssignableTo(f.Type()) {
+		return fmt.Errorf("can't store %s in %s", v.Type(), f.Type())
+	}
+	f.Set(v)
+	return nil
+}
+
+// fieldValue is the value stored for a struct field: what a pointer points
+// to, or nil.
+func fieldValue(f reflect.Value) interface{} {
+	if f.Kind() == reflect.Ptr {
+		if f.IsNil() {
+			return nil
+		}
+		return f.Elem().Interface()
+	}
+	return f.Interface()
+}
+
+type column struct {
+	name string
+	dbType string
+	notNull bool
+	hasDefault bool
+}
+
+// tableColumns describes the columns of table, or returns none if there is no
+// such table.
+func (b *sqlBackend) tableColumns(table string) ([]column, error) {
+	cols := []column{}
+	query, args := b.dialect.ColumnsQuery(table)
+	rs, err := b.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	for rs.Next() {
+		var nullable string
+		var dflt interface{}
+		var c column
+		if err := rs.Scan(&c.name, &c.dbType, &nullable, &dflt); err != nil {
+			return nil, err
+		}
+		c.notNull = strings.EqualFold(nullable, "NO")
+		c.hasDefault = dflt != nil
+		cols = append(cols, c)
+	}
+	return cols, rs.Err()
+}
+
+// affinity sorts a database column type into the broad kinds of value it
+// holds, following sqlite's rules for type affinity with a few additions for
+// other databases' type names.
+func affinity(dbType string) string {
+	t := strings.ToUpper(dbType)
+	switch {
+	case strings.Contains(t, "INT"):
+		return "integer"
+	case strings.Contains(t, "CHAR"), strings.Contains(t, "CLOB"), strings.Contains(t, "TEXT"):
+		return "text"
+	case t == "", strings.Contains(t, "BLOB"), strings.Contains(t, "BYTEA"), strings.Contains(t, "BINARY"):
+		return "blob"
+	case strings.Contains(t, "REAL"), strings.Contains(t, "FLOA"), strings.Contains(t, "DOUB"):
+		return "real"
+	case strings.Contains(t, "BOOL"):
+		return "boolean"
+	}
+	return "numeric"
+}
+
+// compatible reports whether fields of type t can be stored in columns with
+// the given affinity and read back unchanged.
+func compatible(t reflect.Type, aff string) bool {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return compatible(t.Elem(), aff)
+	case reflect.Bool:
+		return aff == "boolean" || aff == "integer" || aff == "numeric"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return aff == "integer" || aff == "numeric"
+	case reflect.Float32, reflect.Float64:
+		return aff == "real" || aff == "numeric"
+	case reflect.String:
+		return aff == "text"
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.Uint8 && (aff == "blob" || aff == "text")
+	}
+	return false
+}
+
+// A SchemaError describes how a component's struct type and its table
+// disagree.
+type SchemaError struct {
+	Component string
+	Table string
+	// Struct fields with no column to store them in
+	MissingColumns []string
+	// Columns which need a value on insert but which no field provides
+	ExtraColumns []string
+	// Fields whose type can't be stored in their column, as "field: why"
+	TypeMismatches []string
+}
+
+func (e *SchemaError) Error() string {
+	problems := []string{}
+	if len(e.MissingColumns) > 0 {
+		problems = append(problems, "missing columns " + strings.Join(e.MissingColumns, ", "))
+	}
+	if len(e.ExtraColumns) > 0 {
+		problems = append(problems, "extra non-null columns " + strings.Join(e.ExtraColumns, ", "))
+	}
+	if len(e.TypeMismatches) > 0 {
+		problems = append(problems, "incompatible types for " + strings.Join(e.TypeMismatches, ", "))
+	}
+	return fmt.Sprintf("Table %s doesn't match component %s: %s", e.Table, e.Component, strings.Join(problems, "; "))
+}
+
+// validateTable checks that every stored field of the component has a column
+// of a compatible type in its table, and that inserting the component won't
+// leave required columns empty.
+func (b *sqlBackend) validateTable(ctype *ComponentType) error {
+	cols, err := b.tableColumns(ctype.table)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]column)
+	for _, c := range cols {
+		byName[strings.ToLower(c.name)] = c
+	}
+	e := &SchemaError{ Component: ctype.name, Table: ctype.table }
+	ec := strings.ToLower(b.entityColumn)
+	if _, ok := byName[ec]; !ok {
+		e.MissingColumns = append(e.MissingColumns, b.entityColumn)
+	}
+	delete(byName, ec)
+	for i, f := range ctype.fields {
+		c, ok := byName[strings.ToLower(f.column)]
+		if !ok {
+			e.MissingColumns = append(e.MissingColumns, f.column)
+			continue
+		}
+		delete(byName, strings.ToLower(f.column))
+		// columns are quoted, so they have to be named as the database
+		// has them, which isn't as written in the DDL if it folds case
+		ctype.fields[i].column = c.name
+		t := ctype.typ.Field(f.index).Type
+		if !compatible(t, affinity(c.dbType)) {
+			e.TypeMismatches = append(e.TypeMismatches, fmt.Sprintf("%s: %s field, %s column", f.name, t, c.dbType))
+		}
+	}
+	for _, c := range cols {
+		if _, ok := byName[strings.ToLower(c.name)]; ok && c.notNull && !c.hasDefault {
+			e.ExtraColumns = append(e.ExtraColumns, c.name)
+		}
+	}
+	if len(e.MissingColumns) > 0 || len(e.ExtraColumns) > 0 || len(e.TypeMismatches) > 0 {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package spellbook
+
+import (
+	"testing"
+)
+
+type Stats struct {
+	Name string
+	Level uint8
+	Speed float32
+	Alive bool
+}
+
+func TestAutoCreatingComponent(t *testing.T) {
+	m := getEmptyManager()
+
+	err := m.RegisterComponent("stats", "stats", Stats{}, nil)
+	if err == nil {
+		t.Fatal("Registered a component with a missing table without AutoCreate")
+	}
+	err = m.RegisterComponent("stats", "stats", Stats{}, nil, AutoCreate())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, _ := m.NewEntity()
+	c, err := e.NewComponent("stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := c.data.(*Stats)
+	s.Name = "bob"
+	s.Level = 7
+	s.Speed = 1.5
+	s.Alive = true
+	err = c.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = e.GetComponent("stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = c.data.(*Stats)
+	if s.Name != "bob" || s.Level != 7 || s.Speed != 1.5 || !s.Alive {
+		t.Error("Retrieved wrong data", s)
+	}
+}
+
+func TestAutoCreatingExistingTable(t *testing.T) {
+	m := getEmptyManager()
+
+	err := m.RegisterComponent("xyz!", "xyz", Xyz{}, nil, AutoCreate())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAutoCreatingUnsupportedType(t *testing.T) {
+	m := getEmptyManager()
+
+	type bad struct {
+		M map[string]int
+	}
+	err := m.RegisterComponent("bad", "bad", bad{}, nil, AutoCreate())
+	if err == nil {
+		t.Error("Created a table for a struct with a map field")
+	}
+}
+
+func TestRegisteringMismatchedComponent(t *testing.T) {
+	db := getEmptyDB()
+	m, _ := NewManager(db)
+	db.Exec("create table mismatch (entity_id integer not null primary key, X text not null, W integer not null, V integer default 3 not null, U integer)")
+
+	type mismatch struct {
+		X int
+		Y int
+	}
+	err := m.RegisterComponent("mismatch", "mismatch", mismatch{}, nil)
+	se, ok := err.(*SchemaError)
+	if !ok {
+		t.Fatal("Expected a SchemaError, got", err)
+	}
+	if len(se.MissingColumns) != 1 || se.MissingColumns[0] != "Y" {
+		t.Error("Wrong missing columns", se.MissingColumns)
+	}
+	if len(se.ExtraColumns) != 1 || se.ExtraColumns[0] != "W" {
+		t.Error("Wrong extra columns", se.ExtraColumns)
+	}
+	if len(se.TypeMismatches) != 1 {
+		t.Error("Wrong type mismatches", se.TypeMismatches)
+	}
+
+	cns := m.GetComponentNames()
+	if len(cns) != 0 {
+		t.Error("Mismatched component shows up in GetComponentNames!")
+	}
+}
+
+type Tagged struct {
+	Name string `spellbook:"label"`
+	Count int
+	Scratch string `spellbook:"-"`
+	hidden int
+}
+
+func TestStructTags(t *testing.T) {
+	db := getEmptyDB()
+	db.Exec("create table tagged (owner integer not null primary key, label text not null, Count integer not null)")
+	m, err := NewManager(db, EntityColumn("owner"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.RegisterComponent("tagged", "tagged", Tagged{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := m.componentTypes["tagged"].Fields()
+	if len(fields) != 2 || fields[0] != (Field{ "Name", "label", 0 }) || fields[1] != (Field{ "Count", "Count", 1 }) {
+		t.Error("Got fields", fields)
+	}
+
+	e, _ := m.NewEntity()
+	c, _ := e.NewComponent("tagged")
+	tg := c.data.(*Tagged)
+	tg.Name = "thing"
+	tg.Count = 4
+	tg.Scratch = "not saved"
+	tg.hidden = 2
+	err = c.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var label string
+	db.QueryRow("select label from tagged where owner = ?", e.id).Scan(&label)
+	if label != "thing" {
+		t.Error("Tagged field not stored in its column:", label)
+	}
+
+	q := m.QueryComponent("tagged")
+	Eq(q, "Name", "thing")
+	cs, err := q.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cs.Next() {
+		t.Fatal("Query by tagged field found nothing", cs.Err())
+	}
+	tg = cs.Component().data.(*Tagged)
+	if tg.Name != "thing" || tg.Count != 4 || tg.Scratch != "" || tg.hidden != 0 {
+		t.Error("Retrieved wrong data", tg)
+	}
+	cs.Close()
+}
@@ -5,35 +5,90 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
-	"strings"
+	"sort"
 )
 
 var (
 	ErrComponentNotRegistered = errors.New("No component registered with that name")
 	ErrComponentAlreadyRegistered = errors.New("Component name already registered")
 	ErrNoComponent = errors.New("Entity does not have that Component")
+	ErrDuplicateComponent = errors.New("Entity already has that Component")
 	ErrUnsatisfiedDependencies = errors.New("Entity lacks one or more dependencies of the desired component")
+	ErrNoEntity = errors.New("No entity with that ID")
 )
 
-type componentType struct {
+// A ComponentType describes a registered kind of component to the Backend
+// storing it.
+type ComponentType struct {
+	name string
 	table string
 	typ reflect.Type
-	local map[int64]interface{}
+	fields []field
+	local bool
 	dependencies []string
+	registration registration
+	migrations []Migration
+}
+
+// Name is the name the component was registered with.
+func (ct *ComponentType) Name() string {
+	return ct.name
+}
+
+// Table is the table given when registering the component, if any.
+func (ct *ComponentType) Table() string {
+	return ct.table
+}
+
+// Type is the component's struct type. Backends hand out components as
+// pointers to values of this type.
+func (ct *ComponentType) Type() reflect.Type {
+	return ct.typ
+}
+
+// Fields are the struct fields of the component which are stored, in the
+// order they are declared. Backends should store these and no others.
+func (ct *ComponentType) Fields() []Field {
+	fields := make([]Field, len(ct.fields))
+	for i, f := range ct.fields {
+		fields[i] = Field{ Name: f.name, Column: f.column, Index: f.index }
+	}
+	return fields
 }
 
 type Manager struct {
-	db *sql.DB
-	componentTypes map[string] componentType
+	backend Backend
+	local Backend
+	componentTypes map[string] *ComponentType
+	migrations map[string][]Migration
+	// tx is set on the view of a Manager given by Begin
+	tx *Tx
 }
 
-func NewManager(db *sql.DB) (*Manager, error) {
-	m := new(Manager)
+// NewManager creates a Manager storing its entities in db. Spellbook's own
+// tables, including entities, are created or upgraded as needed.
+func NewManager(db *sql.DB, opts ...ManagerOption) (*Manager, error) {
 	if db == nil {
 		return nil, errors.New("need a database")
 	}
-	m.db = db
-	m.componentTypes = make(map[string] componentType)
+	b, err := NewSQLBackend(db, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return NewManagerWithBackend(b)
+}
+
+// NewManagerWithBackend creates a Manager storing its entities and components
+// in b. Local components are always kept in memory.
+func NewManagerWithBackend(b Backend) (*Manager, error) {
+	if b == nil {
+		return nil, errors.New("need a backend")
+	}
+	m := new(Manager)
+	m.backend = b
+	m.local = NewLocalBackend()
+	m.componentTypes = make(map[string] *ComponentType)
+	m.migrations = make(map[string][]Migration)
 	return m, nil
 }
 
@@ -50,22 +105,73 @@ type Component struct {
 	data interface{}
 }
 
-func (m *Manager) RegisterComponent(name string, table string, obj interface{}, deps []string) error {
+// backendFor finds the backend storing components of a type.
+func (m *Manager) backendFor(ctype *ComponentType) Backend {
+	if ctype.local {
+		return m.local
+	}
+	return m.backend
+}
+
+// Bind wraps component data loaded by a Backend for use by the Manager's
+// callers. It is meant for Backend implementations. The data must be a value
+// of, or pointer to, the component's type.
+func (m *Manager) Bind(ctype *ComponentType, entity int64, data interface{}) (*Component, error) {
+	p, err := ctype.pointerTo(data)
+	if err != nil {
+		return nil, err
+	}
+	return &Component{ entity: entity, name: ctype.name, isNew: false, manager: m, data: p }, nil
+}
+
+// pointerTo checks that data is a value of, or non-nil pointer to, the
+// component's type, and returns it as a pointer.
+func (ctype *ComponentType) pointerTo(data interface{}) (interface{}, error) {
+	v := reflect.ValueOf(data)
+	switch {
+	case !v.IsValid():
+	case v.Type() == reflect.PtrTo(ctype.typ) && !v.IsNil():
+		return data, nil
+	case v.Type() == ctype.typ:
+		p := reflect.New(ctype.typ)
+		p.Elem().Set(v)
+		return p.Interface(), nil
+	}
+	return nil, fmt.Errorf("Incompatible types: expected %s, got %T", ctype.typ, data)
+}
+
+func (m *Manager) RegisterComponent(name string, table string, obj interface{}, deps []string, opts ...RegisterOption) error {
 	if _, ok := m.componentTypes[name]; ok {
 		return ErrComponentAlreadyRegistered
 	}
-	if _, err := m.db.Exec("select 1 from " + table + " where 1 = 0"); err != nil {
+	var r registration
+	for _, opt := range opts {
+		opt(&r)
+	}
+	fields, err := structFields(reflect.TypeOf(obj))
+	if err != nil {
 		return err
 	}
-	m.componentTypes[name] = componentType{ table: table, typ: reflect.TypeOf(obj), dependencies: deps}
+	ctype := &ComponentType{ name: name, table: table, typ: reflect.TypeOf(obj), fields: fields, dependencies: deps, registration: r, migrations: m.migrations[name] }
+	if err := m.backend.Register(ctype); err != nil {
+		return err
+	}
+	m.componentTypes[name] = ctype
 	return nil
 }
 func (m *Manager) RegisterLocalComponent(name string, obj interface{}, deps []string) error {
 	if _, ok := m.componentTypes[name]; ok {
 		return ErrComponentAlreadyRegistered
 	}
-	l := make(map[int64]interface{})
-	m.componentTypes[name] = componentType{ typ: reflect.TypeOf(obj), local: l, dependencies: deps }
+	fields, err := structFields(reflect.TypeOf(obj))
+	if err != nil {
+		return err
+	}
+	ctype := &ComponentType{ name: name, typ: reflect.TypeOf(obj), fields: fields, local: true, dependencies: deps }
+	if err := m.local.Register(ctype); err != nil {
+		return err
+	}
+	m.componentTypes[name] = ctype
 	return nil
 }
 func (m *Manager) GetComponentNames() []string {
@@ -77,45 +183,104 @@ func (m *Manager) GetComponentNames() []string {
 }
 
 func (m *Manager) NewEntity() (*Entity, error) {
-	r, err := m.db.Exec("insert into entities values (null)")
+	id, err := m.backend.NewEntity()
 	if err != nil {
 		return nil, err
 	}
-	id, err := r.LastInsertId()
+	return &Entity{id: id, manager: m}, nil
+}
+
+// Entity looks up the entity with the given ID, as returned by Entity.ID.
+func (m *Manager) Entity(id int64) (*Entity, error) {
+	ok, err := m.EntityExists(id)
 	if err != nil {
 		return nil, err
 	}
-	return &Entity{id: id, manager: m}, nil
+	if !ok {
+		return nil, ErrNoEntity
+	}
+	return &Entity{ id: id, manager: m }, nil
+}
+
+// EntityExists reports whether there is an entity with the given ID.
+func (m *Manager) EntityExists(id int64) (bool, error) {
+	return hasEntity(m.backend, id)
 }
 
-func (e *Entity) Delete() error {
-	_, err := e.manager.db.Exec("delete from entities where id = ?", e.id)
+// ID identifies the entity for Manager.Entity.
+func (e *Entity) ID() int64 {
+	return e.id
+}
+
+// Delete removes the entity and all its components, local ones included, and
+// returns the names of the components it had. Components are removed one by
+// one rather than left to the database, so tables needn't cascade deletes.
+func (e *Entity) Delete() ([]string, error) {
+	names := e.manager.GetComponentNames()
+	sort.Strings(names)
+	var removed []string
+	err := e.manager.atomically(func(m *Manager) error {
+		removed = []string{}
+		for _, name := range names {
+			ctype := m.componentTypes[name]
+			err := m.backendFor(ctype).Remove(ctype, e.id)
+			if err == ErrNoComponent {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			removed = append(removed, name)
+		}
+		return m.backend.DeleteEntity(e.id)
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return err
+	return removed, nil
 }
 
 type Entities struct {
-	*sql.Rows
+	ids IDs
 	manager *Manager
 }
 
+func (es *Entities) Next() bool {
+	return es.ids.Next()
+}
+
 func (es *Entities) Entity() (*Entity, error)  {
-	e := &Entity{manager: es.manager}
-	err := es.Scan(&e.id)
-	if err != nil {
+	if err := es.ids.Err(); err != nil {
 		return nil, err
 	}
-	return e, nil
+	return &Entity{ id: es.ids.ID(), manager: es.manager }, nil
+}
+
+func (es *Entities) Err() error {
+	return es.ids.Err()
+}
+
+func (es *Entities) Close() error {
+	return es.ids.Close()
+}
+
+// IDs collects the IDs of the remaining entities and closes the iterator,
+// for use with EntityIn.
+func (es *Entities) IDs() ([]int64, error) {
+	defer es.ids.Close()
+	ids := make([]int64, 0)
+	for es.ids.Next() {
+		ids = append(ids, es.ids.ID())
+	}
+	return ids, es.ids.Err()
 }
 
 func (m *Manager) GetEntities() (*Entities, error) {
-	rs, err := m.db.Query("select id from entities")
+	ids, err := m.backend.Entities()
 	if err != nil {
 		return nil, err
 	}
-	return &Entities{rs, m}, nil
+	return &Entities{ids, m}, nil
 }
 
 func (e *Entity) Components() ([]*Component, error) {
@@ -131,214 +296,193 @@ func (e *Entity) Components() ([]*Component, error) {
 	return cs, nil
 }
 
-// Should only be called by Entity.NewComponent
-func (e *Entity) newDbComponent(name string, ctype componentType) (*Component, error) {
-	r := e.manager.db.QueryRow("select entity_id from " + ctype.table + " where entity_id = ?", e.id)
-	var id int64
-	err := r.Scan(&id)
-	if err != sql.ErrNoRows {
-		return nil, fmt.Errorf("Couldn't create component", name, err)
+func (e *Entity) NewComponent(name string) (*Component, error) {
+	ctype, ok := e.manager.componentTypes[name]
+	if !ok {
+		return nil, ErrComponentNotRegistered
 	}
-	c := Component{ entity: e.id, name: name, isNew: true, manager: e.manager, data: reflect.New(ctype.typ).Interface() }
-	return &c, nil
-}
-
-// Should only be called by Entity.NewComponent
-func (e *Entity) newLocalComponent(name string, ctype componentType) (*Component, error) {
-	_, ok := ctype.local[e.id]
-	if ok {
-		return nil, errors.New("Duplicate component")
+	if err := e.checkDependencies(ctype); err != nil {
+		return nil, err
+	}
+	_, err := e.manager.backendFor(ctype).Get(ctype, e.id)
+	if err == nil {
+		return nil, ErrDuplicateComponent
+	}
+	if err != ErrNoComponent {
+		return nil, fmt.Errorf("Couldn't create component %s: %v", name, err)
 	}
 	c := Component{ entity: e.id, name: name, isNew: true, manager: e.manager, data: reflect.New(ctype.typ).Interface() }
 	return &c, nil
 }
 
-func (e *Entity) NewComponent(name string) (*Component, error) {
-	ctype, ok := e.manager.componentTypes[name]
-	if !ok {
-		return nil, ErrComponentNotRegistered
-	}
+// checkDependencies makes sure the entity has the components a component of
+// type ctype depends on.
+func (e *Entity) checkDependencies(ctype *ComponentType) error {
 	for _, dep := range ctype.dependencies {
 		_, err := e.GetComponent(dep)
 		if err != nil {
-			return nil, ErrUnsatisfiedDependencies
+			return ErrUnsatisfiedDependencies
 		}
 	}
-	if ctype.local != nil {
-		return e.newLocalComponent(name, ctype)
-	}
-	return e.newDbComponent(name, ctype)
+	return nil
 }
 
-func bindComponent(name string, rs *sql.Rows, ctype componentType, manager *Manager) (*Component, error) {
-	var id int64
-	cols, err := rs.Columns()
-	if err != nil {
-		return nil, err
-	}
-	ifaces := make([]interface{}, len(cols))
-	ifaceptrs := make([]interface{}, len(cols))
-	for i := 0; i < len(ifaces); i++ {
-		ifaceptrs[i] = &ifaces[i]
+func (e *Entity) GetComponent(name string) (*Component, error) {
+	ctype, ok := e.manager.componentTypes[name]
+	if !ok {
+		return nil, ErrComponentNotRegistered
 	}
-	err = rs.Scan(ifaceptrs...)
+	data, err := e.manager.backendFor(ctype).Get(ctype, e.id)
 	if err != nil {
 		return nil, err
 	}
-	cv := reflect.New(ctype.typ).Elem()
-	for i, field := range cols {
-		if field == "entity_id" {
-			id = ifaces[i].(int64)
-			continue
-		}
-		f := cv.FieldByName(field)
-		if !f.IsValid() {
-			return nil, fmt.Errorf("Field %s is invalid for %s", field, name)
-		}
-		iv := reflect.ValueOf(ifaces[i])
-		switch iv.Kind() {
-		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-			f.SetInt(iv.Int())
-		default:
-			f.Set(iv)
-		}
-	}
-	return &Component{ entity: id, name: name, isNew: false, manager: manager, data: cv.Addr().Interface() }, nil
+	return e.manager.Bind(ctype, e.id, data)
 }
 
-// Should only be called by GetComponent
-func (e *Entity) getLocalComponent(name string, ctype componentType) (*Component, error) {
-	data, ok := ctype.local[e.id]
+func (e *Entity) RemoveComponent(name string) error {
+	ctype, ok := e.manager.componentTypes[name]
 	if !ok {
-		return nil, ErrNoComponent
+		return ErrComponentNotRegistered
 	}
-	return &Component{ entity: e.id, name: name, isNew: false, manager: e.manager, data: data }, nil
+	return e.manager.backendFor(ctype).Remove(ctype, e.id)
 }
 
-// Should only be called by GetComponent
-func (e *Entity) getDbComponent(name string, ctype componentType) (*Component, error) {
-	rs, err := e.manager.db.Query("select * from " + ctype.table + " where entity_id = ?", e.id)
-	defer rs.Close()
-	if err != nil {
-		return nil, err
-	}
-	if !rs.Next() {
-		return nil, ErrNoComponent
-	}
-	return bindComponent(name, rs, ctype, e.manager)
+// Data is the component's contents, a pointer to a value of its registered
+// type. Changes made through it are stored by Save.
+func (c *Component) Data() interface{} {
+	return c.data
 }
 
-func (e *Entity) GetComponent(name string) (*Component, error) {
-	ctype, ok := e.manager.componentTypes[name]
+// SetData replaces the component's contents with data, a value of or pointer
+// to its registered type. Nothing is stored until Save.
+func (c *Component) SetData(data interface{}) error {
+	ctype, ok := c.manager.componentTypes[c.name]
 	if !ok {
-		return nil, ErrComponentNotRegistered
+		return ErrComponentNotRegistered
 	}
-	if ctype.local != nil {
-		return e.getLocalComponent(name, ctype)
+	p, err := ctype.pointerTo(data)
+	if err != nil {
+		return err
 	}
-	return e.getDbComponent(name, ctype)
-}
-
-func (e *Entity) removeLocalComponent(name string, ctype componentType) error {
-	delete(ctype.local, e.id)
+	c.data = p
 	return nil
 }
 
-func (e *Entity) removeDbComponent(name string, ctype componentType) error {
-	r, err := e.manager.db.Exec("delete from " + ctype.table + " where entity_id = ?", e.id)
+func (c *Component) Save() error {
+	ctype := c.manager.componentTypes[c.name]
+	data, err := ctype.pointerTo(c.data)
 	if err != nil {
 		return err
 	}
-	n, err := r.RowsAffected()
+	err = c.manager.backendFor(ctype).Save(ctype, c.entity, data, c.isNew)
 	if err != nil {
 		return err
 	}
-	if n != 1 {
-		return ErrNoComponent
-	}
+	c.isNew = false
 	return nil
 }
 
-func (e *Entity) RemoveComponent(name string) error {
-	ctype, ok := e.manager.componentTypes[name]
-	if !ok {
-		return ErrComponentNotRegistered
-	}
-	if ctype.local != nil {
-		return e.removeLocalComponent(name, ctype)
+// atomically runs f in a transaction if the Manager's backend supports them,
+// or else just runs it.
+func (m *Manager) atomically(f func(m *Manager) error) error {
+	if _, ok := m.backend.(TxBackend); !ok && m.tx == nil {
+		return f(m)
 	}
-	return e.removeDbComponent(name, ctype)
+	return m.InTx(func(tx *Tx) error {
+		return f(tx.Manager)
+	})
 }
 
-func (c *Component) localSave(ctype componentType, cv reflect.Value) error {
-	ctype.local[c.entity] = c.data
-	c.isNew = false
-	return nil
-}
-
-func (c *Component) dbSave(ctype componentType, cv reflect.Value) error {
-	var query string
-	if c.isNew {
-		columnNames := make([]string, ctype.typ.NumField() + 1)
-		for i := 0; i < len(columnNames) - 1; i++ {
-			columnNames[i] = ctype.typ.Field(i).Name
+// MoveTo gives the component, along with any unsaved changes, to dst. Either
+// it moves or nothing changes; dst must satisfy the component's dependencies
+// and not have one of its own.
+func (c *Component) MoveTo(dst *Entity) error {
+	ctype := c.manager.componentTypes[c.name]
+	data, err := ctype.pointerTo(c.data)
+	if err != nil {
+		return err
+	}
+	if dst.id == c.entity {
+		return nil
+	}
+	err = c.manager.atomically(func(m *Manager) error {
+		if err := (&Entity{ dst.id, m }).checkDependencies(ctype); err != nil {
+			return err
 		}
-		columnNames[ctype.typ.NumField()] = "entity_id"
-		questionMarks := make([]string, ctype.typ.NumField() + 1)
-		for i := 0; i < len(questionMarks); i++ {
-			questionMarks[i] = "?"
+		b := m.backendFor(ctype)
+		_, err := b.Get(ctype, dst.id)
+		if err == nil {
+			return ErrDuplicateComponent
 		}
-		query = "insert into " + ctype.table + " (" + strings.Join(columnNames, ", ") +  ") values (" + strings.Join(questionMarks, ", ") + ")"
-	} else {
-		assignments := make([]string, ctype.typ.NumField())
-		for i := 0; i < len(assignments); i++ {
-			assignments[i] = ctype.typ.Field(i).Name + " = ?"
+		if err != ErrNoComponent {
+			return err
 		}
-		query = "update " + ctype.table + " set " + strings.Join(assignments, ", ") + " where entity_id = ?"
-	}
-	ifaces := make([]interface{}, ctype.typ.NumField() + 1)
-
-	for i := 0; i < len(ifaces) - 1; i++ {
-		ifaces[i] = cv.Field(i).Interface()
-	}
-	ifaces[ctype.typ.NumField()] = interface{}(c.entity)
-	_, err := c.manager.db.Exec(query, ifaces...)
+		if mb, ok := b.(MoveBackend); ok {
+			return mb.Move(ctype, c.entity, dst.id, data)
+		}
+		if _, err := b.Get(ctype, c.entity); err != nil {
+			return err
+		}
+		// saving first means that without a transaction a failure leaves
+		// the component on both entities rather than neither
+		if err := b.Save(ctype, dst.id, data, true); err != nil {
+			return err
+		}
+		return b.Remove(ctype, c.entity)
+	})
 	if err != nil {
 		return err
 	}
+	c.entity = dst.id
 	c.isNew = false
 	return nil
 }
 
-func (c *Component) Save() error {
-	ctype := c.manager.componentTypes[c.name]
-	cv := reflect.ValueOf(c.data).Elem()
-	if (ctype.typ != cv.Type()) {
-		return fmt.Errorf("Incompatible types: expected %s, got %s", ctype.typ, cv.Type())
-	}
-	if ctype.local != nil {
-		return c.localSave(ctype, cv)
-	}
-	return c.dbSave(ctype, cv)
-}
-
-func (c *Component) MoveTo(dst *Entity) error {
-	src := &Entity{ c.entity, c.manager }
-	err := src.RemoveComponent(c.name)
-	if err != nil {
-		return err
-	}
-	dstC, err := dst.NewComponent(c.name)
-	if err != nil {
-		return err
+// SwapComponent exchanges the entity's component of the given type with
+// other's. If only one of them has the component it is moved to the other.
+// Each entity must satisfy the dependencies of the component it receives.
+func (e *Entity) SwapComponent(name string, other *Entity) error {
+	ctype, ok := e.manager.componentTypes[name]
+	if !ok {
+		return ErrComponentNotRegistered
 	}
-	dstC.Data = c.Data
-	err = dstC.Save()
-	if err != nil {
-		return err
+	if e.id == other.id {
+		return nil
 	}
-	c.entity = dstC.entity
-	return nil
+	return e.manager.atomically(func(m *Manager) error {
+		b := m.backendFor(ctype)
+		mine, err := b.Get(ctype, e.id)
+		if err != nil && err != ErrNoComponent {
+			return err
+		}
+		theirs, err := b.Get(ctype, other.id)
+		if err != nil && err != ErrNoComponent {
+			return err
+		}
+		if mine == nil && theirs == nil {
+			return ErrNoComponent
+		}
+		if mine != nil {
+			if err := (&Entity{ other.id, m }).checkDependencies(ctype); err != nil {
+				return err
+			}
+		}
+		if theirs != nil {
+			if err := (&Entity{ e.id, m }).checkDependencies(ctype); err != nil {
+				return err
+			}
+		}
+		if mine == nil {
+			return (&Component{ entity: other.id, name: name, manager: m, data: theirs }).MoveTo(&Entity{ e.id, m })
+		}
+		if theirs == nil {
+			return (&Component{ entity: e.id, name: name, manager: m, data: mine }).MoveTo(&Entity{ other.id, m })
+		}
+		if err := b.Save(ctype, e.id, theirs, false); err != nil {
+			return err
+		}
+		return b.Save(ctype, other.id, mine, false)
+	})
 }
 
 func (c *Component) Entity() *Entity {
@@ -350,73 +494,10 @@ type Components interface {
 	Component() *Component
 	Next() bool
 	Err() error
-}
-
-type sliceComponents struct {
-	slice []*Component
-	index int
-	closed bool
-	err error
-}
-
-func (cs *sliceComponents) Close() error {
-	cs.closed = true
-	cs.slice = nil
-	return cs.err
-}
-
-func (cs *sliceComponents) Component() *Component {
-	if cs.closed {
-		cs.err = errors.New("Iterator already closed")
-		return nil
-	}
-	if cs.index < 0 {
-		cs.err = errors.New("Next() not called on iterator")
-		return nil
-	}
-	return cs.slice[cs.index]
-}
-
-func (cs *sliceComponents) Next() bool {
-	if cs.closed {
-		cs.err = errors.New("Iterator already closed")
-		return false
-	}
-	cs.index += 1
-	return cs.index < len(cs.slice)
-}
-
-func (cs *sliceComponents) Err() error {
-	return cs.err
-}
-
-type dbComponents struct {
-	rows *sql.Rows
-	component *Component
-	name string
-	ctype componentType
-	manager *Manager
-	err error
-}
-
-func (cs *dbComponents) Close() error {
-	return cs.rows.Close()
-}
-func (cs *dbComponents) Component() *Component {
-	return cs.component
-}
-func (cs *dbComponents) Next() bool {
-	if !cs.rows.Next() {
-		return false
-	}
-	cs.component, cs.err = bindComponent(cs.name, cs.rows, cs.ctype, cs.manager)
-	return cs.err == nil
-}
-func (cs *dbComponents) Err() error {
-	if cs.err != nil {
-		return cs.err
-	}
-	return cs.rows.Err()
+	// Cursor marks the position of the current component, or of the last
+	// one once Next has returned false, for Query.After to resume from. If
+	// there were none it is the cursor the query was resumed from.
+	Cursor() string
 }
 
 func (m *Manager) GetComponents(name string) (Components, error) {
@@ -425,23 +506,40 @@ func (m *Manager) GetComponents(name string) (Components, error) {
 
 type Query interface {
 	Run() (Components, error)
-	Where(string, interface{}, string)
-}
-
-type localQuery struct {
-	name string
-	ctype componentType
-	manager *Manager
-	wheres []func (reflect.Value) bool
-}
-
-type dbQuery struct {
-	name string
-	ctype componentType
-	manager *Manager
-	wheres []string
-	args []interface{}
-	err error
+	// Where restricts the query to components whose field compares with val
+	// as op says; see Compare for the operators. A *FilterError is returned
+	// if the field doesn't exist, the operator is unknown or val can't be
+	// compared with the field. It is also returned by Run and the other
+	// methods running the query, so it can be checked once at the end.
+	Where(field string, val interface{}, op string) error
+	// Filter restricts the query to components matching e, returning an
+	// error like Where does. Like Where, it can be called several times,
+	// and all the conditions have to match.
+	Filter(e Expr) error
+	// OrderBy sorts components by a field, after any fields already
+	// ordered by. Null fields come first in ascending order, and ties are
+	// broken by entity ID.
+	OrderBy(field string, order Order)
+	// Limit returns at most n components.
+	Limit(n int)
+	// Offset skips the first n components.
+	Offset(n int)
+	// After resumes the query after the component whose cursor is given,
+	// which has to come from a query with the same ordering. Unlike Offset,
+	// it doesn't skip or repeat components added or removed meanwhile.
+	After(cursor string)
+
+	// Count is the number of components the query finds.
+	Count() (int64, error)
+	// Exists reports whether the query finds any component.
+	Exists() (bool, error)
+	// Sum, Min, Max and Avg aggregate a numeric field of the components the
+	// query finds, skipping nulls. Min, Max and Avg return ErrNoValues if
+	// there is nothing to aggregate, while Sum returns 0.
+	Sum(field string) (float64, error)
+	Min(field string) (float64, error)
+	Max(field string) (float64, error)
+	Avg(field string) (float64, error)
 }
 
 func (m *Manager) QueryComponent(name string) Query {
@@ -449,136 +547,60 @@ func (m *Manager) QueryComponent(name string) Query {
 	if !ok {
 		return &dbQuery{ err: ErrComponentNotRegistered }
 	}
-	if ctype.local != nil {
-		return &localQuery{ name: name, ctype: ctype, manager: m, wheres: make([]func (reflect.Value) bool, 0) }
-	} else {
-		return &dbQuery{ name: name, ctype: ctype, manager: m, wheres: make([]string, 0), args: make([]interface{}, 0) }
-	}
-	return nil
+	return m.backendFor(ctype).Query(m, ctype)
 }
 
-func (q *dbQuery) toString() string {
-	s := "select * from " + q.ctype.table
-	if len(q.wheres) > 0 {
-		s += " where " + strings.Join(q.wheres, " and ")
-	}
-	return s
+func Eq(q Query, field string, val interface{}) error {
+	return q.Where(field, val, "=")
 }
 
-func (q *localQuery) Run() (Components, error) {
-	cs := make([]*Component, 0)
-	for id, data := range q.ctype.local {
-		excluded := false
-		c := Component{ entity: id, name: q.name, isNew: false, manager: q.manager, data: data }
-		for _, pred := range q.wheres {
-			cv := reflect.ValueOf(c.data)
-			if !pred(cv) {
-				excluded = true
-				break
-			}
-		}
-		if !excluded {
-			cs = append(cs, &c)
-		}
-	}
+func Gt(q Query, field string, val interface{}) error {
+	return q.Where(field, val, ">")
+}
 
-	return &sliceComponents{ cs, -1, false, nil }, nil
-}
-
-func (q *localQuery) Where(field string, other interface{}, op string) {
-	pred := func(val reflect.Value) bool {
-		f := val.Elem().FieldByName(field)
-		switch op {
-		case "=":
-			return f == reflect.ValueOf(other)
-		case "!=":
-			return f != reflect.ValueOf(other)
-		case "<":
-			switch f.Kind() {
-			case reflect.String:
-				return f.String() < other.(string)
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				return f.Int() < reflect.ValueOf(other).Int()
-			case reflect.Float32, reflect.Float64:
-				return f.Float() < reflect.ValueOf(other).Float()
-			}
-		case ">":
-			switch f.Kind() {
-			case reflect.String:
-				return f.String() > other.(string)
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				return f.Int() > reflect.ValueOf(other).Int()
-			case reflect.Float32, reflect.Float64:
-				return f.Float() > reflect.ValueOf(other).Float()
-			}
-		case "<=":
-			switch f.Kind() {
-			case reflect.String:
-				return f.String() <= other.(string)
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				return f.Int() <= reflect.ValueOf(other).Int()
-			case reflect.Float32, reflect.Float64:
-				return f.Float() <= reflect.ValueOf(other).Float()
-			}
-		case ">=":
-			switch f.Kind() {
-			case reflect.String:
-				return f.String() >= other.(string)
-			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-				return f.Int() >= reflect.ValueOf(other).Int()
-			case reflect.Float32, reflect.Float64:
-				return f.Float() >= reflect.ValueOf(other).Float()
-			}
-		}
-		return false
-	}
-	q.wheres = append(q.wheres, pred)
+func Gte(q Query, field string, val interface{}) error {
+	return q.Where(field, val, ">=")
 }
 
-func (q *dbQuery) Run() (Components, error) {
-	if q.err != nil {
-		return nil, q.err
-	}
-	rs, err := q.manager.db.Query(q.toString(), q.args...)
-	if err != nil {
-		return nil, err
-	}
-	c := new(dbComponents)
-	c.rows = rs
-	c.name = q.name
-	c.ctype = q.ctype
-	c.manager = q.manager
-	return c, nil
+func Lt(q Query, field string, val interface{}) error {
+	return q.Where(field, val, "<")
 }
 
-func (q *dbQuery) Where(field string, val interface{}, op string) {
-	// todo: check that field name exists
-	s := fmt.Sprintf("%s %s ?", field, op)
-	q.wheres = append(q.wheres, s)
-	q.args = append(q.args, val)
+func Lte(q Query, field string, val interface{}) error {
+	return q.Where(field, val, "<=")
 }
 
-func Eq(q Query, field string, val interface{}) {
-	q.Where(field, val, "=")
+func Neq(q Query, field string, val interface{}) error {
+	return q.Where(field, val, "!=")
 }
 
-func Gt(q Query, field string, val interface{}) {
-	q.Where(field, val, ">")
+// In matches fields equal to one of vals, which must be a slice.
+func In(q Query, field string, vals interface{}) error {
+	return q.Where(field, vals, "in")
 }
 
-func Gte(q Query, field string, val interface{}) {
-	q.Where(field, val, ">=")
+// Between matches fields from lo to hi inclusive.
+func Between(q Query, field string, lo interface{}, hi interface{}) error {
+	return q.Where(field, []interface{}{ lo, hi }, "between")
 }
 
-func Lt(q Query, field string, val interface{}) {
-	q.Where(field, val, "<")
+// Like matches string fields against a pattern ignoring case, where % stands
+// for any run of characters and _ for any one character.
+func Like(q Query, field string, pattern string) error {
+	return q.Where(field, pattern, "like")
 }
 
-func Lte(q Query, field string, val interface{}) {
-	q.Where(field, val, "<=")
+// HasPrefix matches string fields starting with prefix.
+func HasPrefix(q Query, field string, prefix string) error {
+	return q.Where(field, prefix, "prefix")
 }
 
-func Neq(q Query, field string, val interface{}) {
-	q.Where(field, val, "!=")
+// IsNull matches pointer fields which are nil.
+func IsNull(q Query, field string) error {
+	return q.Where(field, nil, "is null")
 }
 
+// NotNull matches fields which aren't nil.
+func NotNull(q Query, field string) error {
+	return q.Where(field, nil, "is not null")
+}
@@ -14,7 +14,6 @@ func getEmptyDB() *sql.DB {
 	db, err := sql.Open("sqlite3", dbName)
 	// todo: further investigate cascading deletes
 	sqls := []string{
-		"create table entities (id integer not null primary key)",
 		"create table xyz (entity_id integer not null primary key references entities(id) on delete cascade, X integer not null, Y integer not null, Z integer not null)",
 		"create table nd (entity_id integer not null primary key references entities(id) on delete cascade, N text not null)",
 	}
@@ -33,6 +32,22 @@ func getEmptyManager() *Manager {
 	return m
 }
 
+// forEachBackend runs f with an empty Manager backed by sqlite, then with one
+// kept in memory, so that tests can check both behave alike.
+func forEachBackend(t *testing.T, f func(m *Manager)) {
+	db, err := NewManager(getEmptyDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := NewManagerWithBackend(NewLocalBackend())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []*Manager{ db, local } {
+		f(m)
+	}
+}
+
 func TestEmptyManagerWithoutDb(t *testing.T) {
 	_, err := NewManager(nil)
 	if err == nil {
@@ -108,6 +123,48 @@ func TestDifferentEntityIds(t *testing.T) {
 	}
 }
 
+// listingBackend hides any HasEntity method of the Backend it wraps.
+type listingBackend struct {
+	Backend
+}
+
+func TestEntityByID(t *testing.T) {
+	check := func(m *Manager) {
+		m.RegisterLocalComponent("nd", Nd{}, nil)
+		e, _ := m.NewEntity()
+		c, _ := e.NewComponent("nd")
+		c.data.(*Nd).N = "hi"
+		c.Save()
+
+		found, err := m.Entity(e.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found.ID() != e.ID() {
+			t.Error("Found entity", found.ID(), "instead of", e.ID())
+		}
+		if c, err := found.GetComponent("nd"); err != nil || c.data.(*Nd).N != "hi" {
+			t.Error("Couldn't get component of entity found by ID:", err)
+		}
+		if ok, err := m.EntityExists(e.ID() + 1); err != nil || ok {
+			t.Error("Nonexistent entity exists", err)
+		}
+		if _, err := m.Entity(e.ID() + 1); err != ErrNoEntity {
+			t.Error("Got", err, "instead of ErrNoEntity")
+		}
+		e.Delete()
+		if ok, err := m.EntityExists(e.ID()); err != nil || ok {
+			t.Error("Deleted entity exists", err)
+		}
+	}
+	forEachBackend(t, check)
+	listing, err := NewManagerWithBackend(listingBackend{ NewLocalBackend() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(listing)
+}
+
 type Xyz struct {
 	X int
 	Y int
@@ -206,7 +263,7 @@ func TestCreatingAndSavingComponent(t *testing.T) {
 func TestUpdatingComponent(t *testing.T) {
 	m := getEmptyManager()
 
-	m.RegisterComponent("xyz!", "xyz", Xyz{})
+	m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
 
 	e, _ := m.NewEntity()
 
@@ -234,6 +291,40 @@ func TestUpdatingComponent(t *testing.T) {
 	}
 }
 
+func TestSettingComponentData(t *testing.T) {
+	m := getEmptyManager()
+	m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
+
+	e, _ := m.NewEntity()
+	c, _ := e.NewComponent("xyz!")
+	if err := c.SetData(Nd{ "no" }); err == nil {
+		t.Error("Set data of the wrong type")
+	}
+	if err := c.SetData((*Xyz)(nil)); err == nil {
+		t.Error("Set nil data")
+	}
+	if err := c.SetData(Xyz{ 1, 2, 3 }); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, _ = e.GetComponent("xyz!")
+	xyz, ok := c.Data().(*Xyz)
+	if !ok || *xyz != (Xyz{ 1, 2, 3 }) {
+		t.Error("Retrieved wrong data", c.Data())
+	}
+	if err := c.SetData(&Xyz{ 4, 5, 6 }); err != nil {
+		t.Fatal(err)
+	}
+	c.Save()
+	c, _ = e.GetComponent("xyz!")
+	if *c.Data().(*Xyz) != (Xyz{ 4, 5, 6 }) {
+		t.Error("Retrieved wrong data", c.Data())
+	}
+}
+
 func TestRemovingComponent(t *testing.T) {
 	m := getEmptyManager()
 	m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
@@ -261,19 +352,28 @@ func TestDeletingEntity(t *testing.T) {
 	m := getEmptyManager()
 
 	m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
+	m.RegisterLocalComponent("nd", Nd{}, nil)
 
 	e, _ := m.NewEntity()
-	err := e.Delete()
-	if err != nil {
-		t.Error("Failed to delete empty entity")
+	removed, err := e.Delete()
+	if err != nil || len(removed) != 0 {
+		t.Error("Failed to delete empty entity", removed, err)
 	}
 
 	e, _ = m.NewEntity()
 
 	c, _ := e.NewComponent("xyz!")
 	c.Save()
+	c, _ = e.NewComponent("nd")
+	c.Save()
 
-	err = e.Delete()
+	removed, err = e.Delete()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 || removed[0] != "nd" || removed[1] != "xyz!" {
+		t.Error("Reported removing", removed)
+	}
 
 	es, err := m.GetEntities()
 	if err != nil {
@@ -284,7 +384,13 @@ func TestDeletingEntity(t *testing.T) {
 	}
 	es.Close()
 
-	// todo: test Components list to make sure component was deleted
+	// sqlite doesn't cascade deletes unless asked to, so this checks the
+	// components were removed explicitly
+	for _, name := range []string{ "xyz!", "nd" } {
+		if _, err := e.GetComponent(name); err != ErrNoComponent {
+			t.Error("Component", name, "survived its entity:", err)
+		}
+	}
 }
 
 type Nd struct {
@@ -547,8 +653,8 @@ func TestLocalComponent(t *testing.T) {
 
 func TestLocalQueries(t *testing.T) {
 	m := getEmptyManager()
-	m.RegisterComponent("xyz!", "xyz", Xyz{})
-	m.RegisterLocalComponent("So?", So{})
+	m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
+	m.RegisterLocalComponent("So?", So{}, nil)
 
 	e, _ := m.NewEntity()
 	c, _ := e.NewComponent("So?")
@@ -653,7 +759,7 @@ func TestMovingComponents(t *testing.T) {
 	id2 := e2.id
 
 	c, _ := e1.NewComponent("xyz!")
-	c.Data.(*Xyz).X = 35
+	c.data.(*Xyz).X = 35
 	c.Save()
 
 	err := c.MoveTo(e2)
@@ -673,8 +779,83 @@ func TestMovingComponents(t *testing.T) {
 	if err != nil {
 		t.Fatal("Error getting component from destintion after moving", err)
 	}
-	if c.Data.(*Xyz).X != 35 {
+	if c.data.(*Xyz).X != 35 {
 		t.Error("Wrong data for moved component!")
 	}
 }
 
+
+func TestMovingComponentWithUnsatisfiedDependencies(t *testing.T) {
+	m := getEmptyManager()
+
+	m.RegisterComponent("Xyz!", "xyz", Xyz{}, nil)
+	m.RegisterComponent("N?", "nd", Nd{}, []string{"Xyz!"})
+
+	e1, _ := m.NewEntity()
+	e2, _ := m.NewEntity()
+	c, _ := e1.NewComponent("Xyz!")
+	c.Save()
+	c, _ = e1.NewComponent("N?")
+	c.data.(*Nd).N = "stays"
+	c.Save()
+
+	err := c.MoveTo(e2)
+	if err != ErrUnsatisfiedDependencies {
+		t.Error("Moved component to entity lacking its dependencies", err)
+	}
+	if c.entity != e1.id {
+		t.Error("Entity of component changed by failed move", c.entity)
+	}
+	c, err = e1.GetComponent("N?")
+	if err != nil {
+		t.Fatal("Component lost by failed move", err)
+	}
+	if c.data.(*Nd).N != "stays" {
+		t.Error("Wrong data for component after failed move")
+	}
+}
+
+func TestSwappingComponents(t *testing.T) {
+	m := getEmptyManager()
+
+	m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
+	m.RegisterLocalComponent("So?", So{}, nil)
+
+	e1, _ := m.NewEntity()
+	e2, _ := m.NewEntity()
+	c, _ := e1.NewComponent("xyz!")
+	c.data.(*Xyz).X = 1
+	c.Save()
+	c, _ = e2.NewComponent("xyz!")
+	c.data.(*Xyz).X = 2
+	c.Save()
+	c, _ = e1.NewComponent("So?")
+	c.data.(*So).What = "local"
+	c.Save()
+
+	if err := e1.SwapComponent("xyz!", e2); err != nil {
+		t.Fatal(err)
+	}
+	c, _ = e1.GetComponent("xyz!")
+	if c.data.(*Xyz).X != 2 {
+		t.Error("Wrong data for first entity after swapping")
+	}
+	c, _ = e2.GetComponent("xyz!")
+	if c.data.(*Xyz).X != 1 {
+		t.Error("Wrong data for second entity after swapping")
+	}
+
+	if err := e2.SwapComponent("So?", e1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e1.GetComponent("So?"); err != ErrNoComponent {
+		t.Error("Component not missing after swapping it away", err)
+	}
+	c, err := e2.GetComponent("So?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.data.(*So).What != "local" {
+		t.Error("Wrong data for swapped local component")
+	}
+}
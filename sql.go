@@ -0,0 +1,717 @@
+package spellbook
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// sqlBackend stores entities in an entities table and each type of component
+// in its own table, keyed by entity ID.
+type sqlBackend struct {
+	db *sql.DB
+	// q runs statements, on db or on a transaction
+	q querier
+	dialect Dialect
+	entityColumn string
+}
+
+// querier is what *sql.DB and *sql.Tx have in common.
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// A ManagerOption changes how a Manager maps components to the database.
+type ManagerOption func(*sqlBackend)
+
+// EntityColumn sets the name of the column holding the entity ID in component
+// tables, which defaults to entity_id.
+func EntityColumn(name string) ManagerOption {
+	return func(b *sqlBackend) {
+		b.entityColumn = name
+	}
+}
+
+// NewSQLBackend creates a Backend storing entities and components in db.
+// Spellbook's own tables, including entities, are created or upgraded as
+// needed.
+func NewSQLBackend(db *sql.DB, opts ...ManagerOption) (Backend, error) {
+	b := &sqlBackend{ db: db, q: db, dialect: SQLite, entityColumn: "entity_id" }
+	for _, opt := range opts {
+		opt(b)
+	}
+	if err := b.bootstrap(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *sqlBackend) exec(query string, args ...interface{}) (sql.Result, error) {
+	return b.q.Exec(rebind(b.dialect, query), args...)
+}
+
+func (b *sqlBackend) query(query string, args ...interface{}) (*sql.Rows, error) {
+	return b.q.Query(rebind(b.dialect, query), args...)
+}
+
+func (b *sqlBackend) quote(ident string) string {
+	return b.dialect.Quote(ident)
+}
+
+func (b *sqlBackend) NewEntity() (int64, error) {
+	query, returning := b.dialect.InsertEntity()
+	if returning {
+		var id int64
+		err := b.q.QueryRow(query).Scan(&id)
+		return id, err
+	}
+	r, err := b.q.Exec(query)
+	if err != nil {
+		return 0, err
+	}
+	return r.LastInsertId()
+}
+
+func (b *sqlBackend) DeleteEntity(id int64) error {
+	_, err := b.exec("delete from entities where id = ?", id)
+	return err
+}
+
+type rowIDs struct {
+	*sql.Rows
+	id int64
+	err error
+}
+
+func (ids *rowIDs) Next() bool {
+	if !ids.Rows.Next() {
+		return false
+	}
+	ids.err = ids.Scan(&ids.id)
+	return ids.err == nil
+}
+
+func (ids *rowIDs) ID() int64 {
+	return ids.id
+}
+
+func (ids *rowIDs) Err() error {
+	if ids.err != nil {
+		return ids.err
+	}
+	return ids.Rows.Err()
+}
+
+func (b *sqlBackend) Entities() (IDs, error) {
+	rs, err := b.query("select id from entities")
+	if err != nil {
+		return nil, err
+	}
+	return &rowIDs{ Rows: rs }, nil
+}
+
+func (b *sqlBackend) HasEntity(id int64) (bool, error) {
+	rs, err := b.query("select 1 from entities where id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	defer rs.Close()
+	return rs.Next(), rs.Err()
+}
+
+func (b *sqlBackend) Register(ctype *ComponentType) error {
+	if err := b.migrate(ctype); err != nil {
+		return err
+	}
+	if _, err := b.exec("select 1 from " + b.quote(ctype.table) + " where 1 = 0"); err != nil {
+		return err
+	}
+	return b.validateTable(ctype)
+}
+
+// qualify prefixes a column with the alias of its table, if there is one.
+func qualify(alias string, column string) string {
+	if alias == "" {
+		return column
+	}
+	return alias + "." + column
+}
+
+// fieldColumns lists the columns of a component's fields, in order.
+func (b *sqlBackend) fieldColumns(alias string, ctype *ComponentType) []string {
+	columns := make([]string, len(ctype.fields))
+	for i, f := range ctype.fields {
+		columns[i] = qualify(alias, b.quote(f.column))
+	}
+	return columns
+}
+
+// selectColumns lists the columns scanComponent expects, in order.
+func (b *sqlBackend) selectColumns(ctype *ComponentType) string {
+	columns := append([]string{ b.quote(b.entityColumn) }, b.fieldColumns("", ctype)...)
+	return strings.Join(columns, ", ")
+}
+
+// scanComponent reads the entity ID and component from a row of the columns
+// given by selectColumns.
+func scanComponent(rs *sql.Rows, ctype *ComponentType) (int64, interface{}, error) {
+	id, data, err := scanComponents(rs, ctype)
+	if err != nil {
+		return 0, nil, err
+	}
+	return id, data[0], nil
+}
+
+// scanComponents reads an entity ID followed by the fields of a component of
+// each type.
+func scanComponents(rs *sql.Rows, ctypes ...*ComponentType) (int64, []interface{}, error) {
+	var id int64
+	n := 1
+	for _, ctype := range ctypes {
+		n += len(ctype.fields)
+	}
+	ifaces := make([]interface{}, n)
+	ifaceptrs := make([]interface{}, len(ifaces))
+	for i := 0; i < len(ifaces); i++ {
+		ifaceptrs[i] = &ifaces[i]
+	}
+	err := rs.Scan(ifaceptrs...)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := setField(reflect.ValueOf(&id).Elem(), reflect.ValueOf(ifaces[0])); err != nil {
+		return 0, nil, fmt.Errorf("Entity ID: %s", err)
+	}
+	data := make([]interface{}, len(ctypes))
+	i := 1
+	for j, ctype := range ctypes {
+		cv := reflect.New(ctype.typ).Elem()
+		for _, field := range ctype.fields {
+			if err := setField(cv.Field(field.index), reflect.ValueOf(ifaces[i])); err != nil {
+				return 0, nil, fmt.Errorf("Field %s of %s: %s", field.name, ctype.name, err)
+			}
+			i++
+		}
+		data[j] = cv.Addr().Interface()
+	}
+	return id, data, nil
+}
+
+func (b *sqlBackend) Get(ctype *ComponentType, entity int64) (interface{}, error) {
+	rs, err := b.query("select " + b.selectColumns(ctype) + " from " + b.quote(ctype.table) + " where " + b.quote(b.entityColumn) + " = ?", entity)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	if !rs.Next() {
+		if err := rs.Err(); err != nil {
+			return nil, err
+		}
+		return nil, ErrNoComponent
+	}
+	_, data, err := scanComponent(rs, ctype)
+	return data, err
+}
+
+func (b *sqlBackend) Save(ctype *ComponentType, entity int64, data interface{}, isNew bool) error {
+	var query string
+	n := len(ctype.fields)
+	if isNew {
+		columnNames := make([]string, n + 1)
+		for i := 0; i < n; i++ {
+			columnNames[i] = b.quote(ctype.fields[i].column)
+		}
+		columnNames[n] = b.quote(b.entityColumn)
+		questionMarks := make([]string, n + 1)
+		for i := 0; i < len(questionMarks); i++ {
+			questionMarks[i] = "?"
+		}
+		query = "insert into " + b.quote(ctype.table) + " (" + strings.Join(columnNames, ", ") +  ") values (" + strings.Join(questionMarks, ", ") + ")"
+	} else {
+		assignments := make([]string, n)
+		for i := 0; i < len(assignments); i++ {
+			assignments[i] = b.quote(ctype.fields[i].column) + " = ?"
+		}
+		query = "update " + b.quote(ctype.table) + " set " + strings.Join(assignments, ", ") + " where " + b.quote(b.entityColumn) + " = ?"
+	}
+	cv := reflect.ValueOf(data).Elem()
+	ifaces := make([]interface{}, n + 1)
+
+	for i := 0; i < n; i++ {
+		ifaces[i] = fieldValue(cv.Field(ctype.fields[i].index))
+	}
+	ifaces[n] = interface{}(entity)
+	_, err := b.exec(query, ifaces...)
+	return err
+}
+
+func (b *sqlBackend) Remove(ctype *ComponentType, entity int64) error {
+	r, err := b.exec("delete from " + b.quote(ctype.table) + " where " + b.quote(b.entityColumn) + " = ?", entity)
+	if err != nil {
+		return err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return ErrNoComponent
+	}
+	return nil
+}
+
+// Move updates the component's entity ID and fields in a single statement.
+func (b *sqlBackend) Move(ctype *ComponentType, from, to int64, data interface{}) error {
+	assignments := make([]string, len(ctype.fields) + 1)
+	ifaces := make([]interface{}, len(ctype.fields) + 2)
+	assignments[0] = b.quote(b.entityColumn) + " = ?"
+	ifaces[0] = to
+	cv := reflect.ValueOf(data).Elem()
+	for i, f := range ctype.fields {
+		assignments[i + 1] = b.quote(f.column) + " = ?"
+		ifaces[i + 1] = fieldValue(cv.Field(f.index))
+	}
+	ifaces[len(ifaces) - 1] = from
+	r, err := b.exec("update " + b.quote(ctype.table) + " set " + strings.Join(assignments, ", ") + " where " + b.quote(b.entityColumn) + " = ?", ifaces...)
+	if err != nil {
+		return err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n != 1 {
+		return ErrNoComponent
+	}
+	return nil
+}
+
+func (b *sqlBackend) Query(m *Manager, ctype *ComponentType) Query {
+	return &dbQuery{ ctype: ctype, backend: b, manager: m, filters: make([]Expr, 0) }
+}
+
+func (b *sqlBackend) Begin() (BackendTx, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	view := *b
+	view.q = tx
+	return &sqlTx{ &view, tx }, nil
+}
+
+// sqlTx runs a sqlBackend's statements in a transaction.
+type sqlTx struct {
+	*sqlBackend
+	tx *sql.Tx
+}
+
+func (tx *sqlTx) Begin() (BackendTx, error) {
+	return nil, ErrNestedTx
+}
+
+func (tx *sqlTx) Commit() error {
+	return tx.tx.Commit()
+}
+
+func (tx *sqlTx) Rollback() error {
+	return tx.tx.Rollback()
+}
+
+type dbComponents struct {
+	rows *sql.Rows
+	component *Component
+	ctype *ComponentType
+	manager *Manager
+	paging *paging
+	err error
+}
+
+func (cs *dbComponents) Close() error {
+	return cs.rows.Close()
+}
+func (cs *dbComponents) Component() *Component {
+	return cs.component
+}
+func (cs *dbComponents) Next() bool {
+	if !cs.rows.Next() {
+		return false
+	}
+	id, data, err := scanComponent(cs.rows, cs.ctype)
+	if err != nil {
+		cs.err = err
+		return false
+	}
+	cs.component, cs.err = cs.manager.Bind(cs.ctype, id, data)
+	return cs.err == nil
+}
+func (cs *dbComponents) Cursor() string {
+	return cs.paging.cursor(cs.ctype, cs.component)
+}
+func (cs *dbComponents) Err() error {
+	if cs.err != nil {
+		return cs.err
+	}
+	return cs.rows.Err()
+}
+
+type dbQuery struct {
+	ctype *ComponentType
+	backend *sqlBackend
+	manager *Manager
+	filters []Expr
+	paging
+	err error
+}
+
+// conditions renders the query's filters on its table, known in the
+// statement as alias if that isn't empty, along with their arguments.
+func (q *dbQuery) conditions(alias string) ([]string, []interface{}, error) {
+	s := make([]string, len(q.filters))
+	args := make([]interface{}, 0)
+	for i, e := range q.filters {
+		if err := e.check(q.ctype); err != nil {
+			return nil, nil, err
+		}
+		s[i] = q.render(e, alias, &args)
+	}
+	return s, args, nil
+}
+
+// render writes an expression in SQL, adding the values it compares to args.
+func (q *dbQuery) render(e Expr, alias string, args *[]interface{}) string {
+	switch e.op {
+	case "and", "or":
+		if len(e.operands) == 0 {
+			if e.op == "and" {
+				return "1 = 1"
+			}
+			return "1 = 0"
+		}
+		parts := make([]string, len(e.operands))
+		for i, o := range e.operands {
+			parts[i] = q.render(o, alias, args)
+		}
+		return "(" + strings.Join(parts, " " + e.op + " ") + ")"
+	case "not":
+		return "not " + q.render(e.operands[0], alias, args)
+	}
+	// check has made sure the field exists
+	column := q.backend.quote(q.backend.entityColumn)
+	if !e.entity {
+		f, _ := q.ctype.field(e.field)
+		column = q.backend.quote(f.column)
+	}
+	column = qualify(alias, column)
+	switch e.op {
+	case "is null", "is not null":
+		return column + " " + e.op
+	case "in":
+		vals := reflect.ValueOf(e.value)
+		if vals.Len() == 0 {
+			return "1 = 0"
+		}
+		if ids, ok := e.value.([]int64); ok && e.entity {
+			return entityIn(column, ids)
+		}
+		marks := make([]string, vals.Len())
+		for i := range marks {
+			marks[i] = "?"
+			*args = append(*args, vals.Index(i).Interface())
+		}
+		return column + " in (" + strings.Join(marks, ", ") + ")"
+	case "between":
+		vals := reflect.ValueOf(e.value)
+		*args = append(*args, vals.Index(0).Interface(), vals.Index(1).Interface())
+		return column + " between ? and ?"
+	case "like":
+		// the escape character is passed as a parameter since databases
+		// disagree about backslashes in string literals
+		*args = append(*args, e.value, `\`)
+		return "lower(" + column + ") like lower(?) escape ?"
+	case "prefix":
+		*args = append(*args, e.value)
+		return fmt.Sprintf("substr(%s, 1, %d) = ?", column, utf8.RuneCountInString(e.value.(string)))
+	}
+	*args = append(*args, e.value)
+	return fmt.Sprintf("%s %s ?", column, e.op)
+}
+
+// entityBatch is how many entity IDs are listed in each in (...) of
+// entityIn.
+const entityBatch = 500
+
+// entityIn matches any of a set of entity IDs. The IDs are written out as
+// numbers, so that no database's limit on query parameters is hit.
+func entityIn(column string, ids []int64) string {
+	batches := make([]string, 0, len(ids) / entityBatch + 1)
+	for start := 0; start < len(ids); start += entityBatch {
+		end := start + entityBatch
+		if end > len(ids) {
+			end = len(ids)
+		}
+		nums := make([]string, end - start)
+		for i, id := range ids[start:end] {
+			nums[i] = strconv.FormatInt(id, 10)
+		}
+		batches = append(batches, column + " in (" + strings.Join(nums, ", ") + ")")
+	}
+	if len(batches) == 1 {
+		return batches[0]
+	}
+	return "(" + strings.Join(batches, " or ") + ")"
+}
+
+func (q *dbQuery) toString() string {
+	s, _, _ := q.statement()
+	return s
+}
+
+// statement is the query's SQL along with its arguments.
+func (q *dbQuery) statement() (string, []interface{}, error) {
+	s := "select " + q.backend.selectColumns(q.ctype) + " from " + q.backend.quote(q.ctype.table)
+	wheres, args, err := q.conditions("")
+	if err != nil {
+		return "", nil, err
+	}
+	after, err := q.afterCursor(q.ctype)
+	if err != nil {
+		return "", nil, err
+	}
+	if after != nil {
+		wheres = append(wheres, q.render(*after, "", &args))
+	}
+	if len(wheres) > 0 {
+		s += " where " + strings.Join(wheres, " and ")
+	}
+	if q.paged() {
+		order, err := q.orderClause()
+		if err != nil {
+			return "", nil, err
+		}
+		s += order
+	}
+	return rebind(q.backend.dialect, s), args, nil
+}
+
+// orderClause sorts and pages the query's results. Nulls are sorted first in
+// ascending order, as they are in memory.
+func (q *dbQuery) orderClause() (string, error) {
+	fields, err := q.orderFields(q.ctype)
+	if err != nil {
+		return "", err
+	}
+	keys := make([]string, 0)
+	for i, f := range fields {
+		dir := " asc"
+		if q.orders[i].order == Desc {
+			dir = " desc"
+		}
+		column := q.backend.quote(f.column)
+		if q.ctype.typ.Field(f.index).Type.Kind() == reflect.Ptr {
+			keys = append(keys, "case when " + column + " is null then 0 else 1 end" + dir)
+		}
+		keys = append(keys, column + dir)
+	}
+	keys = append(keys, q.backend.quote(q.backend.entityColumn) + " asc")
+	s := " order by " + strings.Join(keys, ", ")
+	if q.hasLimit {
+		s += fmt.Sprintf(" limit %d", q.limit)
+	} else if q.offset > 0 {
+		// not every database takes an offset without a limit
+		s += fmt.Sprintf(" limit %d", int64(math.MaxInt64))
+	}
+	if q.offset > 0 {
+		s += fmt.Sprintf(" offset %d", q.offset)
+	}
+	return s, nil
+}
+
+func (q *dbQuery) Run() (Components, error) {
+	if q.err != nil {
+		return nil, q.err
+	}
+	query, args, err := q.statement()
+	if err != nil {
+		return nil, err
+	}
+	rs, err := q.backend.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	c := new(dbComponents)
+	c.rows = rs
+	c.ctype = q.ctype
+	c.manager = q.manager
+	c.paging = &q.paging
+	return c, nil
+}
+
+func (q *dbQuery) Count() (int64, error) {
+	if q.err != nil {
+		return 0, q.err
+	}
+	query, args, err := q.statement()
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	err = q.backend.q.QueryRow("select count(*) from (" + query + ") q", args...).Scan(&n)
+	return n, err
+}
+
+func (q *dbQuery) Exists() (bool, error) {
+	if q.err != nil {
+		return false, q.err
+	}
+	query, args, err := q.statement()
+	if err != nil {
+		return false, err
+	}
+	rs, err := q.backend.q.Query("select 1 from (" + query + ") q limit 1", args...)
+	if err != nil {
+		return false, err
+	}
+	defer rs.Close()
+	exists := rs.Next()
+	return exists, rs.Err()
+}
+
+func (q *dbQuery) Sum(field string) (float64, error) {
+	return q.aggregate("sum", field)
+}
+
+func (q *dbQuery) Min(field string) (float64, error) {
+	return q.aggregate("min", field)
+}
+
+func (q *dbQuery) Max(field string) (float64, error) {
+	return q.aggregate("max", field)
+}
+
+func (q *dbQuery) Avg(field string) (float64, error) {
+	return q.aggregate("avg", field)
+}
+
+// aggregate runs a SQL aggregate function over a field of the query's
+// components, which are selected by a subquery so that paging applies.
+func (q *dbQuery) aggregate(fn string, field string) (float64, error) {
+	if q.err != nil {
+		return 0, q.err
+	}
+	f, err := numericField(q.ctype, field)
+	if err != nil {
+		return 0, err
+	}
+	query, args, err := q.statement()
+	if err != nil {
+		return 0, err
+	}
+	var result sql.NullFloat64
+	err = q.backend.q.QueryRow("select " + fn + "(" + qualify("q", q.backend.quote(f.column)) + ") from (" + query + ") q", args...).Scan(&result)
+	if err != nil {
+		return 0, err
+	}
+	if !result.Valid {
+		if fn == "sum" {
+			return 0, nil
+		}
+		return 0, ErrNoValues
+	}
+	return result.Float64, nil
+}
+
+func (q *dbQuery) Where(field string, val interface{}, op string) error {
+	return q.Filter(Compare(field, op, val))
+}
+
+func (q *dbQuery) Filter(e Expr) error {
+	if q.err != nil {
+		return q.err
+	}
+	if err := e.check(q.ctype); err != nil {
+		q.err = err
+		return err
+	}
+	q.filters = append(q.filters, e)
+	return nil
+}
+
+// sqlBackendOf finds the sqlBackend behind b, if there is one.
+func sqlBackendOf(b Backend) (*sqlBackend, bool) {
+	switch b := b.(type) {
+	case *sqlBackend:
+		return b, true
+	case *sqlTx:
+		return b.sqlBackend, true
+	}
+	return nil, false
+}
+
+// join finds the entities with a component matching each of qs, joining
+// their tables on the entity column, but none of the types without. It
+// returns the rows of the entities' components, in the order of qs, sorted
+// by entity. Without any qs, it goes through the entities table instead.
+func (b *sqlBackend) join(qs []*dbQuery, without []*ComponentType) ([]tuple, error) {
+	ctypes := make([]*ComponentType, len(qs))
+	key := qualify("t0", b.quote(b.entityColumn))
+	from := "entities t0"
+	if len(qs) == 0 {
+		key = qualify("t0", "id")
+	}
+	columns := []string{ key }
+	wheres := make([]string, 0)
+	args := make([]interface{}, 0)
+	for i, q := range qs {
+		alias := fmt.Sprintf("t%d", i)
+		ctypes[i] = q.ctype
+		columns = append(columns, b.fieldColumns(alias, q.ctype)...)
+		if i == 0 {
+			from = b.quote(q.ctype.table) + " " + alias
+		} else {
+			from += " join " + b.quote(q.ctype.table) + " " + alias + " on " + qualify(alias, b.quote(b.entityColumn)) + " = " + key
+		}
+		conditions, conditionArgs, err := q.conditions(alias)
+		if err != nil {
+			return nil, err
+		}
+		wheres = append(wheres, conditions...)
+		args = append(args, conditionArgs...)
+	}
+	for i, ctype := range without {
+		alias := fmt.Sprintf("w%d", i)
+		wheres = append(wheres, "not exists (select 1 from " + b.quote(ctype.table) + " " + alias + " where " + qualify(alias, b.quote(b.entityColumn)) + " = " + key + ")")
+	}
+	s := "select " + strings.Join(columns, ", ") + " from " + from
+	if len(wheres) > 0 {
+		s += " where " + strings.Join(wheres, " and ")
+	}
+	s += " order by " + key
+	rs, err := b.query(s, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rs.Close()
+	rows := make([]tuple, 0)
+	for rs.Next() {
+		id, data, err := scanComponents(rs, ctypes...)
+		if err != nil {
+			return nil, err
+		}
+		row := tuple{ id, make([]*Component, len(qs)) }
+		for i, q := range qs {
+			row.components[i], err = q.manager.Bind(q.ctype, id, data[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, rs.Err()
+}
@@ -0,0 +1,118 @@
+package spellbook
+
+import (
+	"errors"
+)
+
+var (
+	ErrTxUnsupported = errors.New("Backend does not support transactions")
+	ErrNestedTx = errors.New("Already in a transaction")
+	ErrTxDone = errors.New("Transaction already committed or rolled back")
+)
+
+// A Tx is a view of a Manager whose changes, to both stored and local
+// components, all take effect on Commit or not at all. Entities and
+// components got through a Tx make their changes in it.
+type Tx struct {
+	*Manager
+	backends []BackendTx
+	done bool
+}
+
+// Begin starts a transaction. The Manager's backend has to be a TxBackend.
+func (m *Manager) Begin() (*Tx, error) {
+	if m.tx != nil {
+		return nil, ErrNestedTx
+	}
+	b, ok := m.backend.(TxBackend)
+	if !ok {
+		return nil, ErrTxUnsupported
+	}
+	l, ok := m.local.(TxBackend)
+	if !ok {
+		return nil, ErrTxUnsupported
+	}
+	btx, err := b.Begin()
+	if err != nil {
+		return nil, err
+	}
+	ltx, err := l.Begin()
+	if err != nil {
+		btx.Rollback()
+		return nil, err
+	}
+	view := *m
+	view.backend = btx
+	view.local = ltx
+	tx := &Tx{ Manager: &view, backends: []BackendTx{ btx, ltx } }
+	view.tx = tx
+	return tx, nil
+}
+
+// Commit makes the transaction's changes. Stored components are committed
+// first, and local ones are rolled back if that fails.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	if err := tx.backends[0].Commit(); err != nil {
+		tx.backends[1].Rollback()
+		return err
+	}
+	return tx.backends[1].Commit()
+}
+
+// Rollback discards the transaction's changes.
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+	err := tx.backends[0].Rollback()
+	if lerr := tx.backends[1].Rollback(); err == nil {
+		err = lerr
+	}
+	return err
+}
+
+// In is the entity as seen in tx, so that changes made through it are part
+// of the transaction. Changes made through an Entity got from the Manager
+// the transaction was begun on bypass it, and may wait on it for locks.
+func (e *Entity) In(tx *Tx) *Entity {
+	return &Entity{ e.id, tx.Manager }
+}
+
+// In is the component as seen in tx, unsaved changes included, so that
+// saving or moving it is part of the transaction.
+func (c *Component) In(tx *Tx) *Component {
+	in := *c
+	in.manager = tx.Manager
+	return &in
+}
+
+// InTx runs f in a transaction, which is committed if f returns nil and
+// rolled back otherwise. Called on a Tx, f joins that transaction instead,
+// leaving it to the outermost caller to commit. Entities and components from
+// outside have to be brought into the transaction with In, or looked up
+// through tx.
+func (m *Manager) InTx(f func(tx *Tx) error) (err error) {
+	if m.tx != nil {
+		return f(m.tx)
+	}
+	tx, err := m.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,188 @@
+package spellbook
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestTxRollback(t *testing.T) {
+	m := getEmptyManager()
+	m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
+	m.RegisterLocalComponent("So?", So{}, nil)
+	e, _ := m.NewEntity()
+	c, _ := e.NewComponent("So?")
+	c.data.(*So).Haha = 1
+	c.Save()
+
+	tx, err := m.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	te := e.In(tx)
+	c, _ = te.NewComponent("xyz!")
+	c.data.(*Xyz).X = 5
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	c, _ = te.GetComponent("So?")
+	c.data.(*So).Haha = 2
+	c.Save()
+	if _, err := tx.NewEntity(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.GetComponent("xyz!"); err != ErrNoComponent {
+		t.Error("Rolled back component still there:", err)
+	}
+	c, _ = e.GetComponent("So?")
+	if c.data.(*So).Haha != 1 {
+		t.Error("Local component not rolled back")
+	}
+	es, _ := m.GetEntities()
+	n := 0
+	for es.Next() {
+		n++
+	}
+	es.Close()
+	if n != 1 {
+		t.Error("Got", n, "entities instead of 1")
+	}
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Error("Committed a rolled back transaction:", err)
+	}
+}
+
+func TestTxCommit(t *testing.T) {
+	m := getEmptyManager()
+	m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
+	m.RegisterComponent("N?", "nd", Nd{}, nil)
+
+	err := m.InTx(func(tx *Tx) error {
+		e, err := tx.NewEntity()
+		if err != nil {
+			return err
+		}
+		c, _ := e.NewComponent("xyz!")
+		c.data.(*Xyz).Y = 3
+		if err := c.Save(); err != nil {
+			return err
+		}
+		if _, err := tx.Begin(); err != ErrNestedTx {
+			t.Error("Began a nested transaction:", err)
+		}
+		return tx.InTx(func(tx *Tx) error {
+			c, _ := e.NewComponent("N?")
+			c.data.(*Nd).N = "both"
+			return c.Save()
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs, err := m.QueryComponent("N?").Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cs.Close()
+	if !cs.Next() {
+		t.Fatal("Committed component missing")
+	}
+	e := &Entity{ cs.Component().entity, m }
+	c, err := e.GetComponent("xyz!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.data.(*Xyz).Y != 3 {
+		t.Error("Retrieved wrong data")
+	}
+}
+
+func TestInTxError(t *testing.T) {
+	m := getEmptyManager()
+	m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
+	e, _ := m.NewEntity()
+
+	failed := errors.New("failed")
+	err := m.InTx(func(tx *Tx) error {
+		c, _ := e.In(tx).NewComponent("xyz!")
+		c.Save()
+		return failed
+	})
+	if err != failed {
+		t.Error("Got", err, "instead of the callback's error")
+	}
+	if _, err := e.GetComponent("xyz!"); err != ErrNoComponent {
+		t.Error("Component saved despite error:", err)
+	}
+}
+
+func TestFileBackendTx(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.spellbook")
+	m, b := openFileManager(t, path)
+	e, _ := m.NewEntity()
+	c, _ := e.NewComponent("xyz!")
+	c.data.(*Xyz).X = 1
+	c.Save()
+
+	tx, _ := m.Begin()
+	c, _ = e.In(tx).GetComponent("xyz!")
+	c.data.(*Xyz).X = 2
+	c.Save()
+	tx.Rollback()
+	c, _ = e.GetComponent("xyz!")
+	if c.data.(*Xyz).X != 1 {
+		t.Error("Change not rolled back")
+	}
+
+	tx, _ = m.Begin()
+	te := e.In(tx)
+	te.RemoveComponent("xyz!")
+	other, _ := tx.NewEntity()
+	c, _ = other.NewComponent("xyz!")
+	c.data.(*Xyz).X = 3
+	c.Save()
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	m, b = openFileManager(t, path)
+	defer b.Close()
+	if _, err := (&Entity{ e.id, m }).GetComponent("xyz!"); err != ErrNoComponent {
+		t.Error("Removed component still there:", err)
+	}
+	c, err := (&Entity{ other.id, m }).GetComponent("xyz!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.data.(*Xyz).X != 3 {
+		t.Error("Retrieved wrong data")
+	}
+}
+
+func TestComponentInTx(t *testing.T) {
+	m := getEmptyManager()
+	m.RegisterComponent("xyz!", "xyz", Xyz{}, nil)
+	e, _ := m.NewEntity()
+	c, _ := e.NewComponent("xyz!")
+	c.Save()
+
+	c.data.(*Xyz).X = 5
+	tx, err := m.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.In(tx).Save(); err != nil {
+		t.Fatal(err)
+	}
+	tx.Rollback()
+	c, _ = e.GetComponent("xyz!")
+	if c.data.(*Xyz).X != 0 {
+		t.Error("Saved outside the transaction")
+	}
+}